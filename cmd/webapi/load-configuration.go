@@ -8,6 +8,9 @@ import (
 	"io"
 	"os"
 	"time"
+	"wasa-project/service/api"
+	"wasa-project/service/ratelimit"
+	"wasa-project/service/unfurl"
 )
 
 // WebAPIConfiguration describes the web API configuration. This structure is automatically parsed by
@@ -27,6 +30,46 @@ type WebAPIConfiguration struct {
 	DB    struct {
 		Filename string `conf:"default:/tmp/decaf.db"`
 	}
+	Auth struct {
+		TokenKey          string        `conf:"mask"`
+		TokenIssuer       string        `conf:"default:wasatext"`
+		TokenTTL          time.Duration `conf:"default:24h"`
+		AllowLegacyTokens bool          `conf:"default:false"`
+		RequirePasswords  bool          `conf:"default:true"`
+		MaxLoginFailures  int           `conf:"default:5"`
+		LoginLockout      time.Duration `conf:"default:15m"`
+	}
+	OIDC struct {
+		Issuer       string
+		ClientID     string
+		ClientSecret string `conf:"mask"`
+		RedirectURL  string
+	}
+	Messages struct {
+		// EditWindow is how long after sending a message can be edited. Zero means no limit
+		EditWindow time.Duration `conf:"default:0s"`
+		// ForwardedManyTimes is the number of forwards after which a message is flagged as "forwarded many times"
+		ForwardedManyTimes int `conf:"default:4"`
+		// DeletedRetention is how long the photos of deleted messages are kept before being purged
+		DeletedRetention time.Duration `conf:"default:720h"`
+		// MaxPins is the maximum number of pinned messages in a conversation
+		MaxPins int `conf:"default:10"`
+	}
+	// LinkPreviews configures the previews of the links sent in messages. Allow is a comma-separated list of networks
+	// (e.g., "10.1.0.0/16") that can be fetched even if they are not public
+	LinkPreviews struct {
+		Enabled  bool          `conf:"default:true"`
+		Timeout  time.Duration `conf:"default:5s"`
+		MaxBytes int64         `conf:"default:524288"`
+		Allow    string
+	}
+	// RateLimit contains the per-route limits, in the form "<requests>/<duration>" (e.g., "10/1m"). Empty or "0"
+	// disables the limit
+	RateLimit struct {
+		Login    string `conf:"default:10/1m"`
+		Messages string `conf:"default:60/1m"`
+		Uploads  string `conf:"default:10/1m"`
+	}
 }
 
 // loadConfiguration creates a WebAPIConfiguration starting from flags, environment variables and configuration file.
@@ -68,3 +111,36 @@ func loadConfiguration() (WebAPIConfiguration, error) {
 
 	return cfg, nil
 }
+
+// rateLimits parses the RateLimit section of the configuration
+func (cfg WebAPIConfiguration) rateLimits() (api.RateLimits, error) {
+	var out api.RateLimits
+	var err error
+	if out.Login, err = ratelimit.ParseLimit(cfg.RateLimit.Login); err != nil {
+		return out, fmt.Errorf("login: %w", err)
+	}
+	if out.Messages, err = ratelimit.ParseLimit(cfg.RateLimit.Messages); err != nil {
+		return out, fmt.Errorf("messages: %w", err)
+	}
+	if out.Uploads, err = ratelimit.ParseLimit(cfg.RateLimit.Uploads); err != nil {
+		return out, fmt.Errorf("uploads: %w", err)
+	}
+	return out, nil
+}
+
+// linkPreviews builds the fetcher of the link previews from the LinkPreviews section of the configuration. It returns
+// nil if link previews are disabled
+func (cfg WebAPIConfiguration) linkPreviews() (unfurl.Fetcher, error) {
+	if !cfg.LinkPreviews.Enabled {
+		return nil, nil
+	}
+	allow, err := unfurl.ParseAllowlist(cfg.LinkPreviews.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	return unfurl.NewHTTPFetcher(unfurl.Config{
+		Timeout:  cfg.LinkPreviews.Timeout,
+		MaxBytes: cfg.LinkPreviews.MaxBytes,
+		Allow:    allow,
+	}), nil
+}
@@ -31,6 +31,7 @@ import (
 	"wasa-project/service/api"
 	"wasa-project/service/database"
 	"wasa-project/service/globaltime"
+	"wasa-project/service/oidc"
 	"github.com/ardanlabs/conf"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
@@ -110,10 +111,40 @@ func run() error {
 	// buffered channel so the goroutine can exit if we don't collect this error.
 	serverErrors := make(chan error, 1)
 
+	rateLimits, err := cfg.rateLimits()
+	if err != nil {
+		logger.WithError(err).Error("invalid rate limit configuration")
+		return fmt.Errorf("parsing rate limits: %w", err)
+	}
+	linkPreviews, err := cfg.linkPreviews()
+	if err != nil {
+		logger.WithError(err).Error("invalid link previews configuration")
+		return fmt.Errorf("parsing link previews: %w", err)
+	}
+
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:            logger,
+		Database:          db,
+		TokenKey:          cfg.Auth.TokenKey,
+		TokenIssuer:       cfg.Auth.TokenIssuer,
+		TokenTTL:          cfg.Auth.TokenTTL,
+		AllowLegacyTokens: cfg.Auth.AllowLegacyTokens,
+		RequirePasswords:  cfg.Auth.RequirePasswords,
+		MaxLoginFailures:  cfg.Auth.MaxLoginFailures,
+		LoginLockout:      cfg.Auth.LoginLockout,
+		OIDC: oidc.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+		},
+		MessageEditWindow:  cfg.Messages.EditWindow,
+		ForwardedManyTimes: cfg.Messages.ForwardedManyTimes,
+		DeletedRetention:   cfg.Messages.DeletedRetention,
+		MaxPinnedMessages:  cfg.Messages.MaxPins,
+		LinkPreviews:       linkPreviews,
+		RateLimits:         rateLimits,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -139,6 +170,10 @@ func run() error {
 		WriteTimeout:      cfg.Web.WriteTimeout,
 	}
 
+	// Start the background jobs (purge of deleted messages, dispatch of scheduled messages, link previews). They are
+	// stopped by apirouter.Close()
+	apirouter.StartWorkers()
+
 	// Start the service listening for requests in a separate goroutine
 	go func() {
 		logger.Infof("API listening on %s", apiserver.Addr)
@@ -150,6 +185,7 @@ func run() error {
 	select {
 	case err := <-serverErrors:
 		// Non-recoverable server error
+		_ = apirouter.Close()
 		return fmt.Errorf("server error: %w", err)
 
 	case sig := <-shutdown:
@@ -9,6 +9,7 @@ require (
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.23
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.27.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
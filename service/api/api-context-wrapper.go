@@ -1,19 +1,46 @@
 package api
 
 import (
-	"wasa-project/service/api/reqcontext"
+	"database/sql"
+	"errors"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"strings"
+	"time"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/auth"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
 )
 
 // httpRouterHandler is the signature for functions that accepts a reqcontext.RequestContext in addition to those
 // required by the httprouter package.
 type httpRouterHandler func(http.ResponseWriter, *http.Request, httprouter.Params, reqcontext.RequestContext)
 
-// wrap parses the request and adds a reqcontext.RequestContext instance related to the request.
+// errNotAuthenticated is returned by authenticate when the request has no valid credentials
+var errNotAuthenticated = errors.New("not authenticated")
+
+// wrap parses the request, authenticates the caller and adds a reqcontext.RequestContext instance related to the
+// request. Requests without a valid token, or whose user does not exist anymore, are rejected with 401. API keys are
+// rejected with 403: bots can use only the routes wrapped with wrapScoped.
 func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return rt.wrapContext(fn, true, "")
+}
+
+// wrapScoped is like wrap, but it also accepts API keys that have the given scope
+func (rt *_router) wrapScoped(scope string, fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return rt.wrapContext(fn, true, scope)
+}
+
+// wrapPublic is like wrap, but the caller is not authenticated (ctx.UserID is empty). Use it only for routes that are
+// meant to be public, like the login.
+func (rt *_router) wrapPublic(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return rt.wrapContext(fn, false, "")
+}
+
+func (rt *_router) wrapContext(fn httpRouterHandler, authenticated bool, scope string) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		reqUUID, err := uuid.NewV4()
 		if err != nil {
@@ -31,7 +58,131 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 			"remote-ip": r.RemoteAddr,
 		})
 
+		// Resolve the caller once for all handlers
+		if authenticated {
+			err = rt.authenticate(r, &ctx)
+			if errors.Is(err, errNotAuthenticated) {
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				ctx.Logger.WithError(err).Error("can't authenticate the request")
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			ctx.Logger = ctx.Logger.WithField("user", ctx.UserID)
+
+			if ctx.APIKey != nil && (scope == "" || !ctx.APIKey.HasScope(scope)) {
+				http.Error(w, "Forbidden: API key not allowed here", http.StatusForbidden)
+				return
+			}
+		}
+
 		// Call the next handler in chain (usually, the handler function for the path)
 		fn(w, r, ps, ctx)
 	}
 }
+
+// sessionTouchInterval is the minimum time between two updates of a session last-seen timestamp
+const sessionTouchInterval = time.Minute
+
+// authenticate checks the bearer token and fills the caller fields of ctx. API keys must be active; signed tokens must
+// refer to a live server-side session; raw user IDs are accepted only when legacy tokens are enabled. In all cases the
+// user must exist. It returns errNotAuthenticated if the credentials are missing or not valid.
+func (rt *_router) authenticate(r *http.Request, ctx *reqcontext.RequestContext) error {
+	raw := bearerToken(r)
+	if raw == "" {
+		return errNotAuthenticated
+	}
+
+	var userID, sessionID string
+	var grant *reqcontext.APIKeyGrant
+	if auth.IsAPIKey(raw) {
+		k, err := rt.checkAPIKey(raw)
+		if err != nil {
+			return err
+		}
+		userID = k.UserID
+		grant = &reqcontext.APIKeyGrant{ID: k.ID, Scopes: k.Scopes, ConversationIDs: k.ConversationIDs}
+	} else if auth.IsSignedToken(raw) {
+		claims, err := rt.tokens.Verify(raw)
+		if err != nil || claims.SessionID == "" {
+			return errNotAuthenticated
+		}
+
+		// Reject revoked sessions and keep track of the last activity
+		s, err := rt.db.GetSession(claims.SessionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotAuthenticated
+		} else if err != nil {
+			return err
+		}
+		if s.RevokedAt != nil || s.UserID != claims.Subject {
+			return errNotAuthenticated
+		}
+		now := globaltime.Now().UTC()
+		if now.Sub(s.LastSeenAt) >= sessionTouchInterval {
+			if err := rt.db.TouchSession(s.ID, now); err != nil {
+				ctx.Logger.WithError(err).Warning("can't update the session last-seen time")
+			}
+		}
+		userID, sessionID = claims.Subject, s.ID
+	} else if rt.allowLegacyTokens {
+		userID = raw
+	} else {
+		return errNotAuthenticated
+	}
+
+	// The user may have been deleted after the token was issued
+	if _, err := rt.db.GetUserByID(userID); errors.Is(err, sql.ErrNoRows) {
+		return errNotAuthenticated
+	} else if err != nil {
+		return err
+	}
+
+	ctx.UserID = userID
+	ctx.SessionID = sessionID
+	ctx.APIKey = grant
+	return nil
+}
+
+// apiKeyTouchInterval is the minimum time between two updates of an API key last-used timestamp
+const apiKeyTouchInterval = time.Minute
+
+// checkAPIKey verifies the API key and returns it. It returns errNotAuthenticated if the key is unknown, revoked or
+// its secret does not match.
+func (rt *_router) checkAPIKey(raw string) (*database.APIKey, error) {
+	id, secret, ok := auth.ParseAPIKey(raw)
+	if !ok {
+		return nil, errNotAuthenticated
+	}
+	k, err := rt.db.GetAPIKey(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotAuthenticated
+	} else if err != nil {
+		return nil, err
+	}
+	if k.RevokedAt != nil || !auth.CheckAPIKeySecret(k.SecretHash, secret) {
+		return nil, errNotAuthenticated
+	}
+
+	now := globaltime.Now().UTC()
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyTouchInterval {
+		if err := rt.db.TouchAPIKey(k.ID, now); err != nil {
+			rt.baseLogger.WithError(err).Warning("can't update the API key last-used time")
+		}
+	}
+	return k, nil
+}
+
+// bearerToken returns the token in the Authorization header. The "Bearer" prefix is optional.
+func bearerToken(r *http.Request) string {
+	raw := strings.TrimSpace(r.Header.Get("Authorization"))
+	if raw == "" {
+		return ""
+	}
+	const p = "Bearer "
+	if len(raw) >= len(p) && strings.HasPrefix(raw, p) {
+		return strings.TrimSpace(raw[len(p):])
+	}
+	return raw
+}
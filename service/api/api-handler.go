@@ -2,9 +2,11 @@ package api
 
 import (
 	"net/http"
+	"wasa-project/service/auth"
 )
 
-// Handler returns an instance of httprouter.Router that handle APIs registered here
+// Handler returns an instance of httprouter.Router that handle APIs registered here. Routes wrapped with rt.wrap
+// require an authenticated caller; public routes must be opted out explicitly (rt.wrapPublic, or no wrapping at all).
 func (rt *_router) Handler() http.Handler {
 
 	// --- Base routes ---
@@ -13,33 +15,75 @@ func (rt *_router) Handler() http.Handler {
 	rt.router.GET("/liveness", rt.liveness)
 
 	// --- Session ---
-	rt.router.POST("/session", rt.wrap(rt.DoLogin))
+	rt.router.POST("/session", rt.wrapPublic(rt.limited("login", rt.rateLimits.Login, rt.DoLogin)))
+	rt.router.GET("/session/oidc/start", rt.wrapPublic(rt.limited("login", rt.rateLimits.Login, rt.OIDCStart)))
+	rt.router.GET("/session/oidc/callback", rt.wrapPublic(rt.limited("login", rt.rateLimits.Login, rt.OIDCCallback)))
+	rt.router.DELETE("/session", rt.wrap(rt.DoLogout))
+	rt.router.GET("/me/sessions", rt.wrap(rt.ListMySessions))
+	rt.router.DELETE("/me/sessions/:id", rt.wrap(rt.RevokeMySession))
 
 	// --- Conversations / Chats ---
 	rt.router.POST("/conversations", rt.wrap(rt.CreateConversation))
-	rt.router.GET("/conversations/:id", rt.wrap(rt.GetConversation))
-	rt.router.POST("/conversations/:id/messages", rt.wrap(rt.SendMessage))
-	rt.router.GET("/me/conversations", rt.wrap(rt.GetMyConversations))
+	rt.router.GET("/conversations/:id", rt.wrapScoped(auth.ScopeMessagesRead, rt.GetConversation))
+	rt.router.POST("/conversations/:id/messages", rt.wrapScoped(auth.ScopeMessagesWrite, rt.limited("messages", rt.rateLimits.Messages, rt.SendMessage)))
+	rt.router.POST("/conversations/:id/read", rt.wrap(rt.MarkConversationRead))
+	rt.router.PUT("/conversations/:id/timer", rt.wrap(rt.SetMessageTimer))
+	rt.router.POST("/conversations/:id/pins", rt.wrap(rt.PinMessage))
+	rt.router.DELETE("/conversations/:id/pins/:messageId", rt.wrap(rt.UnpinMessage))
+	rt.router.GET("/conversations/:id/draft", rt.wrap(rt.GetDraft))
+	rt.router.PUT("/conversations/:id/draft", rt.wrap(rt.SaveDraft))
+	rt.router.POST("/conversations/:id/polls", rt.wrap(rt.limited("messages", rt.rateLimits.Messages, rt.CreatePoll)))
+	rt.router.GET("/me/conversations", rt.wrapScoped(auth.ScopeMessagesRead, rt.GetMyConversations))
 
 	// --- Groups ---
 	rt.router.POST("/groups/:id/members", rt.wrap(rt.AddUserToConversation))
 	rt.router.PUT("/groups/:id/name", rt.wrap(rt.SetGroupName))
-	rt.router.PUT("/groups/:id/photo", rt.wrap(rt.SetGroupPhoto))
+	rt.router.PUT("/groups/:id/photo", rt.wrap(rt.limited("uploads", rt.rateLimits.Uploads, rt.SetGroupPhoto)))
 	rt.router.DELETE("/groups/:id/members", rt.wrap(rt.LeaveGroup))
 
+	// --- Polls ---
+	rt.router.POST("/polls/:id/votes", rt.wrap(rt.VotePoll))
+	rt.router.POST("/polls/:id/close", rt.wrap(rt.ClosePoll))
+
 	// --- Messages ---
-	rt.router.POST("/messages", rt.wrap(rt.SendDirectMessage))
-	rt.router.POST("/messages/:id/forward", rt.wrap(rt.ForwardMessage))
+	rt.router.POST("/messages", rt.wrap(rt.limited("messages", rt.rateLimits.Messages, rt.SendDirectMessage)))
+	rt.router.POST("/messages/:id/forward", rt.wrap(rt.limited("messages", rt.rateLimits.Messages, rt.ForwardMessage)))
 	rt.router.POST("/messages/:id/comments", rt.wrap(rt.CommentMessage))
 	rt.router.DELETE("/messages/:id/comments", rt.wrap(rt.UncommentMessage))
+	rt.router.POST("/messages/:id/reactions", rt.wrap(rt.AddReaction))
+	rt.router.DELETE("/messages/:id/reactions/:emoji", rt.wrap(rt.RemoveReaction))
+	rt.router.PUT("/messages/:id/star", rt.wrap(rt.StarMessage))
+	rt.router.DELETE("/messages/:id/star", rt.wrap(rt.UnstarMessage))
 	rt.router.DELETE("/messages/:id", rt.wrap(rt.DeleteMessage))
+	rt.router.PATCH("/messages/:id", rt.wrap(rt.EditMessage))
+	rt.router.GET("/messages/:id/history", rt.wrap(rt.GetMessageHistory))
+	rt.router.POST("/messages/:id/thread", rt.wrapScoped(auth.ScopeMessagesWrite, rt.limited("messages", rt.rateLimits.Messages, rt.PostThreadReply)))
+	rt.router.GET("/messages/:id/thread", rt.wrapScoped(auth.ScopeMessagesRead, rt.GetThread))
 
 	// --- Users ---
 	rt.router.PUT("/me/username", rt.wrap(rt.SetMyUserName))
-	rt.router.PUT("/me/photo", rt.wrap(rt.SetMyPhoto))
+	rt.router.PUT("/me/photo", rt.wrap(rt.limited("uploads", rt.rateLimits.Uploads, rt.SetMyPhoto)))
 	rt.router.GET("/user/:id", rt.wrap(rt.GetUserByID))
 	rt.router.GET("/users", rt.wrap(rt.SearchUsers))
 
+	// --- Account security ---
+	rt.router.PUT("/me/password", rt.wrap(rt.limited("login", rt.rateLimits.Login, rt.SetMyPassword)))
+	rt.router.POST("/me/2fa/setup", rt.wrap(rt.SetupTOTP))
+	rt.router.POST("/me/2fa/confirm", rt.wrap(rt.limited("login", rt.rateLimits.Login, rt.ConfirmTOTP)))
+	rt.router.DELETE("/me/2fa", rt.wrap(rt.limited("login", rt.rateLimits.Login, rt.DisableTOTP)))
+
+	// --- My messages ---
+	rt.router.GET("/me/scheduled", rt.wrap(rt.GetMyScheduled))
+	rt.router.DELETE("/me/scheduled/:id", rt.wrap(rt.CancelScheduled))
+	rt.router.GET("/me/starred", rt.wrapScoped(auth.ScopeMessagesRead, rt.GetMyStarred))
+	rt.router.GET("/me/mentions", rt.wrapScoped(auth.ScopeMessagesRead, rt.GetMyMentions))
+
+	// --- Bots ---
+	rt.router.POST("/me/bots", rt.wrap(rt.CreateBot))
+	rt.router.GET("/me/bots", rt.wrap(rt.ListMyBots))
+	rt.router.POST("/me/bots/:id/keys", rt.wrap(rt.CreateBotKey))
+	rt.router.DELETE("/me/bots/:id/keys/:keyId", rt.wrap(rt.RevokeBotKey))
+
 	// --- Static files ---
 	rt.router.ServeFiles("/uploads/*filepath", http.Dir("uploads"))
 
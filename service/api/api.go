@@ -37,9 +37,17 @@ See the `main.go` file inside the `cmd/webapi` for a full usage example.
 package api
 
 import (
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
+	"wasa-project/service/auth"
 	"wasa-project/service/database"
+	"wasa-project/service/oidc"
+	"wasa-project/service/ratelimit"
+	"wasa-project/service/unfurl"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
@@ -51,6 +59,44 @@ type Config struct {
 	Logger logrus.FieldLogger
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// TokenKey is the secret used to sign session tokens. If empty, a random key is generated at startup (so issued
+	// tokens will not survive a restart)
+	TokenKey string
+	// TokenIssuer is the issuer stamped on (and required in) session tokens
+	TokenIssuer string
+	// TokenTTL is the lifetime of a session token
+	TokenTTL time.Duration
+	// AllowLegacyTokens makes the API accept the raw user ID as bearer token, like old clients do. It should be enabled
+	// only for the migration period
+	AllowLegacyTokens bool
+
+	// RequirePasswords makes the login of claimed accounts (the ones with a password) require the password. Unclaimed
+	// accounts can always log in with the username only
+	RequirePasswords bool
+	// MaxLoginFailures is the number of consecutive wrong passwords after which the account is locked
+	MaxLoginFailures int
+	// LoginLockout is how long an account stays locked
+	LoginLockout time.Duration
+
+	// OIDC configures the login with an OpenID Connect identity provider. It's disabled if the issuer is empty
+	OIDC oidc.Config
+
+	// MessageEditWindow is how long after sending a message can be edited. Zero means no limit
+	MessageEditWindow time.Duration
+	// ForwardedManyTimes is the number of forwards after which a message is flagged as "forwarded many times"
+	ForwardedManyTimes int
+	// DeletedRetention is how long the photos of deleted messages are kept before being purged
+	DeletedRetention time.Duration
+	// MaxPinnedMessages is the maximum number of messages pinned in a conversation
+	MaxPinnedMessages int
+	// LinkPreviews fetches the previews of the links sent in messages. If nil, link previews are disabled
+	LinkPreviews unfurl.Fetcher
+
+	// RateLimits contains the per-route rate limits
+	RateLimits RateLimits
+	// RateLimitStore keeps the rate limit buckets. If nil, an in-memory store is used
+	RateLimitStore ratelimit.Store
 }
 
 // Router is the package API interface representing an API handler builder
@@ -58,6 +104,9 @@ type Router interface {
 	// Handler returns an HTTP handler for APIs provided in this package
 	Handler() http.Handler
 
+	// StartWorkers starts the background jobs (e.g., the dispatcher of scheduled messages). Close stops them
+	StartWorkers()
+
 	// Close terminates any resource used in the package
 	Close() error
 }
@@ -78,12 +127,74 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = true
 	router.RedirectFixedPath = false
 
+	// Session token signer
+	key := []byte(cfg.TokenKey)
+	if len(key) == 0 {
+		cfg.Logger.Warning("no token key configured, generating a random one: sessions will not survive a restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generating token key: %w", err)
+		}
+	}
+	if cfg.TokenIssuer == "" {
+		cfg.TokenIssuer = "wasatext"
+	}
+	if cfg.TokenTTL == 0 {
+		cfg.TokenTTL = 24 * time.Hour
+	}
+	tokens, err := auth.NewSigner(key, cfg.TokenIssuer, cfg.TokenTTL)
+	if err != nil {
+		return nil, fmt.Errorf("creating token signer: %w", err)
+	}
+	if cfg.MaxLoginFailures <= 0 {
+		cfg.MaxLoginFailures = 5
+	}
+	if cfg.LoginLockout <= 0 {
+		cfg.LoginLockout = 15 * time.Minute
+	}
+	var oidcProvider *oidc.Provider
+	if cfg.OIDC.Issuer != "" {
+		oidcProvider, err = oidc.New(cfg.OIDC)
+		if err != nil {
+			return nil, fmt.Errorf("configuring OIDC: %w", err)
+		}
+	}
+	if cfg.ForwardedManyTimes <= 0 {
+		cfg.ForwardedManyTimes = 4
+	}
+	if cfg.DeletedRetention <= 0 {
+		cfg.DeletedRetention = 30 * 24 * time.Hour
+	}
+	if cfg.MaxPinnedMessages <= 0 {
+		cfg.MaxPinnedMessages = 10
+	}
+	if cfg.RateLimitStore == nil {
+		cfg.RateLimitStore = ratelimit.NewMemoryStore()
+	}
+	if cfg.AllowLegacyTokens {
+		cfg.Logger.Warning("legacy user ID tokens are accepted: disable it once all clients have migrated")
+	}
+
 	// conf the route on the router
 
 	return &_router{
-		router:     router,
-		baseLogger: cfg.Logger,
-		db:         cfg.Database,
+		router:            router,
+		baseLogger:        cfg.Logger,
+		db:                cfg.Database,
+		tokens:            tokens,
+		allowLegacyTokens: cfg.AllowLegacyTokens,
+		requirePasswords:  cfg.RequirePasswords,
+		maxLoginFailures:  cfg.MaxLoginFailures,
+		loginLockout:      cfg.LoginLockout,
+		oidc:              oidcProvider,
+		editWindow:        cfg.MessageEditWindow,
+		manyForwards:      cfg.ForwardedManyTimes,
+		rateLimits:        cfg.RateLimits,
+		limiter:           cfg.RateLimitStore,
+		deletedRetention:  cfg.DeletedRetention,
+		maxPins:           cfg.MaxPinnedMessages,
+		unfurler:          cfg.LinkPreviews,
+		stop:              make(chan struct{}),
 	}, nil
 }
 
@@ -95,4 +206,38 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	// tokens signs and verifies session tokens
+	tokens *auth.Signer
+
+	// allowLegacyTokens enables the old "user ID as bearer token" authentication
+	allowLegacyTokens bool
+
+	// requirePasswords, maxLoginFailures and loginLockout configure the login of claimed accounts
+	requirePasswords bool
+	maxLoginFailures int
+	loginLockout     time.Duration
+
+	// oidc is the external identity provider, nil if not configured
+	oidc *oidc.Provider
+
+	// editWindow is how long after sending a message can be edited (0 = no limit)
+	editWindow time.Duration
+	// manyForwards is the forward count above which forwards are flagged
+	manyForwards int
+	// deletedRetention is how long the photos of tombstones are kept
+	deletedRetention time.Duration
+	// maxPins is the maximum number of pinned messages per conversation
+	maxPins int
+	// unfurler fetches the link previews, nil if disabled
+	unfurler unfurl.Fetcher
+
+	// rateLimits and limiter are used by rt.limited
+	rateLimits RateLimits
+	limiter    ratelimit.Store
+
+	// stop is closed by Close to stop the background workers, which are tracked by workers
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
 }
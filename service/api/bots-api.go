@@ -0,0 +1,251 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/auth"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiKeyRequest is the payload used to request a new API key
+type apiKeyRequest struct {
+	Scopes          []string `json:"scopes"`
+	ConversationIDs []int    `json:"conversationIds"`
+}
+
+// apiKeyResponse is returned when an API key is created. The key itself is never shown again.
+type apiKeyResponse struct {
+	ID              string    `json:"id"`
+	Key             string    `json:"key"`
+	Scopes          []string  `json:"scopes"`
+	ConversationIDs []int     `json:"conversationIds"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// CreateBot creates a bot account owned by the caller, together with its first API key
+func (rt *_router) CreateBot(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	type reqBody struct {
+		Name string `json:"name"`
+		apiKeyRequest
+	}
+	var req reqBody
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if len(name) < 3 || len(name) > 16 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !rt.validAPIKeyRequest(w, uid, req.apiKeyRequest) {
+		return
+	}
+
+	// unicità del nome, come per gli utenti
+	if _, err := rt.db.GetUserByUsername(name); err == nil {
+		http.Error(w, "Bad request: name already taken", http.StatusBadRequest)
+		return
+	} else if err != sql.ErrNoRows {
+		log.Printf("GetUserByUsername: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	botID, err := uuid.NewV4()
+	if err != nil {
+		log.Println("failed to generate uuid:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := rt.db.CreateBot(botID.String(), name, uid); err != nil {
+		log.Printf("CreateBot: %v", err)
+		http.Error(w, "Bad request: name already taken", http.StatusBadRequest)
+		return
+	}
+
+	key, err := rt.createAPIKey(botID.String(), req.apiKeyRequest)
+	if err != nil {
+		log.Printf("createAPIKey: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(struct {
+		ID     string         `json:"id"`
+		Name   string         `json:"name"`
+		APIKey apiKeyResponse `json:"apiKey"`
+	}{
+		ID:     botID.String(),
+		Name:   name,
+		APIKey: *key,
+	})
+}
+
+func (rt *_router) ListMyBots(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	bots, err := rt.db.ListBots(ctx.UserID)
+	if err != nil {
+		log.Printf("ListBots: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	type botView struct {
+		ID    string  `json:"id"`
+		Name  string  `json:"name"`
+		Photo *string `json:"photo,omitempty"`
+	}
+	out := make([]botView, 0, len(bots))
+	for _, b := range bots {
+		out = append(out, botView{ID: b.ID, Name: b.Username, Photo: b.PhotoURL})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// CreateBotKey issues a new API key for one of the caller's bots
+func (rt *_router) CreateBotKey(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	botID := params.ByName("id")
+	if !rt.checkBotOwner(w, botID, uid) {
+		return
+	}
+
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !rt.validAPIKeyRequest(w, uid, req) {
+		return
+	}
+
+	key, err := rt.createAPIKey(botID, req)
+	if err != nil {
+		log.Printf("createAPIKey: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(key)
+}
+
+func (rt *_router) RevokeBotKey(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	botID := params.ByName("id")
+	if !rt.checkBotOwner(w, botID, ctx.UserID) {
+		return
+	}
+
+	revoked, err := rt.db.RevokeAPIKey(params.ByName("keyId"), botID, globaltime.Now().UTC())
+	if err != nil {
+		log.Printf("RevokeAPIKey: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
+
+// checkBotOwner writes a 404 and returns false if the bot does not exist or it's not owned by the user
+func (rt *_router) checkBotOwner(w http.ResponseWriter, botID, userID string) bool {
+	bot, err := rt.db.GetUserByID(botID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return false
+		}
+		log.Printf("GetUserByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if bot.Kind != database.UserKindBot || bot.OwnerID == nil || *bot.OwnerID != userID {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// validAPIKeyRequest checks scopes and conversations of a new key: the owner can restrict a key only to conversations
+// it's a member of. It writes the error response and returns false if the request is not valid.
+func (rt *_router) validAPIKeyRequest(w http.ResponseWriter, ownerID string, req apiKeyRequest) bool {
+	if len(req.Scopes) == 0 {
+		http.Error(w, "Bad request: at least one scope is required", http.StatusBadRequest)
+		return false
+	}
+	for _, s := range req.Scopes {
+		if !auth.ValidScope(s) {
+			http.Error(w, "Bad request: unknown scope "+s, http.StatusBadRequest)
+			return false
+		}
+	}
+	for _, convID := range req.ConversationIDs {
+		if convID <= 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return false
+		}
+		ok, err := rt.db.IsUserInConversation(convID, ownerID)
+		if err != nil {
+			log.Printf("IsUserInConversation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return false
+		}
+		if !ok {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+func (rt *_router) createAPIKey(botID string, req apiKeyRequest) (*apiKeyResponse, error) {
+	id, secret, key, err := auth.NewAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	now := globaltime.Now().UTC()
+	err = rt.db.CreateAPIKey(database.APIKey{
+		ID:              id,
+		UserID:          botID,
+		SecretHash:      auth.HashAPIKeySecret(secret),
+		Scopes:          req.Scopes,
+		ConversationIDs: req.ConversationIDs,
+		CreatedAt:       now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	convIDs := req.ConversationIDs
+	if convIDs == nil {
+		convIDs = []int{}
+	}
+	return &apiKeyResponse{
+		ID:              id,
+		Key:             key,
+		Scopes:          req.Scopes,
+		ConversationIDs: convIDs,
+		CreatedAt:       now,
+	}, nil
+}
@@ -6,28 +6,21 @@ import (
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 func (rt *_router) SendMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	type messageRequest struct {
-		Text string `json:"text"`
-	}
-
 	type messageResponse struct {
 		MessageID int    `json:"messageId"`
 		Status    string `json:"status"`
 	}
 
-	senderID := authUserID(r)
-	if senderID == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	senderID := ctx.UserID
 
 	conversationID, err := strconv.Atoi(params.ByName("id"))
 	if err != nil {
@@ -53,24 +46,39 @@ func (rt *_router) SendMessage(w http.ResponseWriter, r *http.Request, params ht
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	if !ok {
+	if !ok || !ctx.CanAccessConversation(conversationID) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	var req messageRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	req, ok := decodeMessageRequest(w, r)
+	if !ok || !rt.checkReplyTo(w, req, conversationID) {
+		return
+	}
+	photo, err := storeMessagePhoto(req)
+	if err != nil {
+		log.Printf("storeMessagePhoto: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	msg := req.message(conversationID, senderID, photo)
+	if req.ScheduledAt != nil {
+		rt.scheduleMessage(w, msg, *req.ScheduledAt)
 		return
 	}
 
 	// Inserisci e ottieni l'ID del messaggio
-	msgID, err := rt.db.InsertMessage(conversationID, senderID, req.Text)
+	msgID, err := rt.insertMessage(msg)
 	if err != nil {
 		log.Printf("InsertMessage: %v", err)
+		if photo != nil {
+			removeUpload(*photo)
+		}
 		http.Error(w, "failed to send message", http.StatusInternalServerError)
 		return
 	}
+	rt.clearDraft(conversationID, senderID)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -96,11 +104,7 @@ func (rt *_router) CreateConversation(w http.ResponseWriter, r *http.Request, pa
 		return
 	}
 
-	creatorID := authUserID(r)
-	if creatorID == "" {
-		http.Error(w, "missing authorization header", http.StatusUnauthorized)
-		return
-	}
+	creatorID := ctx.UserID
 	id, err := rt.db.CreateConversation(req.Name, req.IsGroup, creatorID)
 	if err != nil {
 		http.Error(w, "could not create convesation", http.StatusInternalServerError)
@@ -114,11 +118,7 @@ func (rt *_router) CreateConversation(w http.ResponseWriter, r *http.Request, pa
 }
 
 func (rt *_router) GetConversation(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	convID, err := strconv.Atoi(params.ByName("id"))
 	if err != nil {
@@ -127,7 +127,8 @@ func (rt *_router) GetConversation(w http.ResponseWriter, r *http.Request, param
 	}
 
 	// 404 se non esiste
-	if _, err := rt.db.GetConversationInfo(convID); err != nil {
+	info, err := rt.db.GetConversationInfo(convID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
@@ -143,7 +144,7 @@ func (rt *_router) GetConversation(w http.ResponseWriter, r *http.Request, param
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	if !ok {
+	if !ok || !ctx.CanAccessConversation(convID) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -155,59 +156,59 @@ func (rt *_router) GetConversation(w http.ResponseWriter, r *http.Request, param
 		return
 	}
 
-	msgs, err := rt.db.ListConversationMessages(convID)
+	// chi legge la conversazione ha ricevuto i messaggi
+	now := globaltime.Now().UTC()
+	if err := rt.db.MarkDelivered(uid, convID, now); err != nil {
+		log.Printf("MarkDelivered: %v", err)
+	}
+
+	msgs, err := rt.db.ListConversationMessages(convID, uid, now)
 	if err != nil {
 		log.Printf("ListConversationMessages: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-
-	type commentView struct {
-		UserID  string `json:"userId"`
-		Comment string `json:"comment"`
+	data, err := rt.loadMessageData(convID, now)
+	if err != nil {
+		log.Printf("loadMessageData: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
 
-	type msgView struct {
-		ID        int           `json:"id"`
-		Sender    string        `json:"sender"`
-		Text      string        `json:"text"`
-		Timestamp time.Time     `json:"timestamp"`
-		Comments  []commentView `json:"comments"`
+	starred, err := rt.db.GetStarredMessageIDs(convID, uid)
+	if err != nil {
+		log.Printf("GetStarredMessageIDs: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
 
-	// mappa []database.Message ---> []msgView con username
 	outMsgs := make([]msgView, 0, len(msgs))
 	for _, m := range msgs {
-		senderName := m.SenderID
-		if u, err := rt.db.GetUserByID(m.SenderID); err == nil && u != nil {
-			senderName = u.Username
-		}
-
-		// prendi i commenti
-		dbComments, _ := rt.db.ListMessageComments(m.ID)
-		cv := make([]commentView, 0, len(dbComments))
-		for _, c := range dbComments {
-			cv = append(cv, commentView{
-				UserID:  c.UserID,
-				Comment: c.Comment,
-			})
-		}
-
-		outMsgs = append(outMsgs, msgView{
-			ID:        m.ID,
-			Sender:    senderName,
-			Text:      m.Text,
-			Timestamp: m.Timestamp,
-			Comments:  cv,
-		})
+		v := rt.messageView(m, uid, data)
+		v.Starred = starred[m.ID]
+		outMsgs = append(outMsgs, v)
+	}
+	// i messaggi fissati sono una lista a parte
+	pinned, err := rt.pinnedViews(convID, uid, data)
+	if err != nil {
+		log.Printf("pinnedViews: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	for i := range pinned {
+		pinned[i].Message.Starred = starred[pinned[i].Message.ID]
 	}
 	resp := struct {
 		ID           int       `json:"id"`
 		Participants []string  `json:"participants"`
+		MessageTTL   int       `json:"messageTtlSeconds"`
+		Pinned       []pinView `json:"pinned"`
 		Messages     []msgView `json:"messages"`
 	}{
 		ID:           convID,
 		Participants: participants,
+		MessageTTL:   info.MessageTTL,
+		Pinned:       pinned,
 		Messages:     outMsgs,
 	}
 
@@ -215,3 +216,287 @@ func (rt *_router) GetConversation(w http.ResponseWriter, r *http.Request, param
 	_ = json.NewEncoder(w).Encode(resp)
 
 }
+
+type commentView struct {
+	UserID  string `json:"userId"`
+	Comment string `json:"comment"`
+}
+
+// forwardedView is the provenance of a forwarded message: the original message, its sender and time
+type forwardedView struct {
+	MessageID int       `json:"messageId"`
+	Sender    string    `json:"sender"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// entityView is a span of the text of a message with a meaning: its formatting (see package richtext) or a mention.
+// Offset and length are in UTF-16 code units.
+type entityView struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	URL      string `json:"url,omitempty"`
+	Language string `json:"language,omitempty"`
+	UserID   string `json:"userId,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// msgView is a message as shown to the members of its conversation
+type msgView struct {
+	ID          int            `json:"id"`
+	Sender      string         `json:"sender"`
+	IsBot       bool           `json:"isBot"`
+	Text        string         `json:"text"`
+	Entities    []entityView   `json:"entities"`
+	PhotoURL    *string        `json:"photoUrl,omitempty"`
+	ReplyTo     *quotedView    `json:"replyTo,omitempty"`
+	Timestamp   time.Time      `json:"timestamp"`
+	EditedAt    *time.Time     `json:"editedAt,omitempty"`
+	DeletedAt   *time.Time     `json:"deletedAt,omitempty"`
+	ExpiresAt   *time.Time     `json:"expiresAt,omitempty"`
+	Forwarded   *forwardedView `json:"forwardedFrom,omitempty"`
+	ManyTimes   bool           `json:"forwardedManyTimes,omitempty"`
+	Starred     bool           `json:"starred"`
+	Status      string         `json:"status"`
+	ReplyCount  int            `json:"replyCount"`
+	LastReplyAt *time.Time     `json:"lastReplyAt,omitempty"`
+	Reactions   []reactionView `json:"reactions"`
+	Previews    []previewView  `json:"linkPreviews"`
+	Poll        *pollView      `json:"poll,omitempty"`
+	Comments    []commentView  `json:"comments"`
+}
+
+// messageView builds the view of the message for the user uid, given the data of its conversation. Tombstones show only
+// who sent them and when they were deleted.
+func (rt *_router) messageView(m database.Message, uid string, d *messageData) msgView {
+	senderName := m.SenderID
+	isBot := false
+	if u := d.user(m.SenderID); u != nil {
+		senderName = u.Username
+		isBot = u.Kind == database.UserKindBot
+	}
+
+	if m.DeletedAt != nil {
+		v := msgView{
+			ID:        m.ID,
+			Sender:    senderName,
+			IsBot:     isBot,
+			Timestamp: m.Timestamp,
+			DeletedAt: m.DeletedAt,
+			Status:    d.receipts[m.ID].Status(),
+			Entities:  []entityView{},
+			Reactions: []reactionView{},
+			Previews:  []previewView{},
+			Comments:  []commentView{},
+		}
+		if t, ok := d.threads[m.ID]; ok {
+			v.ReplyCount = t.ReplyCount
+			v.LastReplyAt = &t.LastReplyAt
+		}
+		return v
+	}
+
+	// le reazioni (i commenti sono la vecchia vista, una per utente ed emoji)
+	reactions := d.reactions[m.ID]
+	cv := make([]commentView, 0, len(reactions))
+	for _, c := range reactions {
+		cv = append(cv, commentView{
+			UserID:  c.UserID,
+			Comment: c.Emoji,
+		})
+	}
+
+	var replyTo *quotedView
+	if m.ReplyToID != nil {
+		replyTo = quotedPreview(d, *m.ReplyToID)
+	}
+
+	v := msgView{
+		ID:        m.ID,
+		Sender:    senderName,
+		IsBot:     isBot,
+		Text:      m.Text,
+		Entities:  messageEntities(d, m.ID),
+		PhotoURL:  m.Photo,
+		ReplyTo:   replyTo,
+		Timestamp: m.Timestamp,
+		EditedAt:  m.EditedAt,
+		ExpiresAt: m.ExpiresAt,
+		Status:    d.receipts[m.ID].Status(),
+		Reactions: aggregateReactions(reactions, uid),
+		Previews:  messagePreviews(d, m.ID),
+		Poll:      messagePoll(d, m.ID, uid),
+		Comments:  cv,
+	}
+	if m.ForwardedFromID != nil {
+		fw := &forwardedView{MessageID: *m.ForwardedFromID}
+		if m.ForwardedSenderID != nil {
+			fw.Sender = d.username(*m.ForwardedSenderID)
+		}
+		if m.ForwardedAt != nil {
+			fw.Timestamp = *m.ForwardedAt
+		}
+		v.Forwarded = fw
+		v.ManyTimes = m.ForwardCount > rt.manyForwards
+	}
+	if t, ok := d.threads[m.ID]; ok {
+		v.ReplyCount = t.ReplyCount
+		v.LastReplyAt = &t.LastReplyAt
+	}
+	return v
+}
+
+// quotePreviewLen is the maximum length of the quoted text shown in replies, in characters
+const quotePreviewLen = 100
+
+// quotedView is the compact preview of the message quoted by a reply
+type quotedView struct {
+	MessageID int    `json:"messageId"`
+	Sender    string `json:"sender,omitempty"`
+	Text      string `json:"text,omitempty"`
+	HasPhoto  bool   `json:"hasPhoto,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+// quotedPreview returns the preview of the quoted message, marked as deleted if it does not exist anymore
+func quotedPreview(d *messageData, messageID int) *quotedView {
+	q, ok := d.quoted[messageID]
+	if !ok || removed(&q, globaltime.Now()) {
+		return &quotedView{MessageID: messageID, Deleted: true}
+	}
+
+	text := truncateRunes(q.Text, quotePreviewLen)
+	if text != q.Text {
+		text += "…"
+	}
+	return &quotedView{
+		MessageID: messageID,
+		Sender:    d.username(q.SenderID),
+		Text:      text,
+		HasPhoto:  q.Photo != nil,
+	}
+}
+
+// MarkConversationRead marks the messages of the conversation as read by the caller, up to the given message
+func (rt *_router) MarkConversationRead(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	convID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || convID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		MessageID int `json:"messageId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// 404 se non esiste
+	if _, err := rt.db.GetConversationInfo(convID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("GetConversationInfo: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// 403 se non sei membro
+	ok, err := rt.db.IsUserInConversation(convID, uid)
+	if err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// il messaggio deve appartenere alla conversazione
+	msg, err := rt.db.GetMessageByID(req.MessageID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || msg.ConversationID != convID {
+		http.Error(w, "Bad request: message not in this conversation", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.db.MarkRead(uid, convID, req.MessageID, globaltime.Now().UTC()); err != nil {
+		log.Printf("MarkRead: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "read"})
+}
+
+// Bounds of the timer of disappearing messages
+const (
+	minMessageTTL = 60                // 1 minute
+	maxMessageTTL = 90 * 24 * 60 * 60 // 90 days
+)
+
+// SetMessageTimer sets the timer of the disappearing messages of a conversation. Any member can change it, and it
+// applies to the messages sent from then on.
+func (rt *_router) SetMessageTimer(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	convID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || convID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		TTLSeconds *int `json:"ttlSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTLSeconds == nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	ttl := *req.TTLSeconds
+	if ttl != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		http.Error(w, "Bad request: ttlSeconds must be 0 (off) or between 60 and 7776000", http.StatusBadRequest)
+		return
+	}
+
+	// 404 se non esiste
+	if _, err := rt.db.GetConversationInfo(convID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("GetConversationInfo: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// 403 se non sei membro
+	ok, err := rt.db.IsUserInConversation(convID, uid)
+	if err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := rt.db.SetMessageTTL(convID, ttl); err != nil {
+		log.Printf("SetMessageTTL: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"messageTtlSeconds": ttl})
+}
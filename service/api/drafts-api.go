@@ -0,0 +1,118 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxDraftLength is the maximum length of a draft, in bytes
+	maxDraftLength = 64 << 10
+	// draftPreviewLength is the number of characters of the draft shown in the list of conversations
+	draftPreviewLength = 100
+)
+
+// draftView is the draft of the caller in a conversation. UpdatedAt is missing if there is no draft.
+type draftView struct {
+	Text      string     `json:"text"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+// draftPreview returns the view of the draft for the list of conversations, with the text shortened
+func draftPreview(d *database.Draft) *draftView {
+	if d == nil {
+		return nil
+	}
+	text := strings.Join(strings.Fields(d.Text), " ")
+	if r := []rune(text); len(r) > draftPreviewLength {
+		text = strings.TrimSpace(string(r[:draftPreviewLength-1])) + "…"
+	}
+	return &draftView{Text: text, UpdatedAt: &d.UpdatedAt}
+}
+
+// clearDraft removes the draft of the user in the conversation, after they sent a message to it. The message is sent
+// anyway, so errors are only logged.
+func (rt *_router) clearDraft(conversationID int, userID string) {
+	if _, err := rt.db.DeleteDraft(conversationID, userID); err != nil {
+		log.Printf("DeleteDraft: %v", err)
+	}
+}
+
+// GetDraft returns the draft of the caller in the conversation (an empty text if there is none)
+func (rt *_router) GetDraft(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	convID, ok := rt.memberConversation(w, params, ctx)
+	if !ok {
+		return
+	}
+
+	out := draftView{}
+	d, err := rt.db.GetDraft(convID, ctx.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("GetDraft: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		out = draftView{Text: d.Text, UpdatedAt: &d.UpdatedAt}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// SaveDraft stores the draft of the caller in the conversation. An empty text removes it.
+func (rt *_router) SaveDraft(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !utf8.ValidString(req.Text) {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Text) > maxDraftLength {
+		http.Error(w, "Bad request: draft too long", http.StatusBadRequest)
+		return
+	}
+
+	convID, ok := rt.memberConversation(w, params, ctx)
+	if !ok {
+		return
+	}
+
+	// una bozza vuota è come nessuna bozza
+	if strings.TrimSpace(req.Text) == "" {
+		if _, err := rt.db.DeleteDraft(convID, ctx.UserID); err != nil {
+			log.Printf("DeleteDraft: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "cleared"})
+		return
+	}
+
+	now := globaltime.Now().UTC()
+	if err := rt.db.SaveDraft(convID, ctx.UserID, req.Text, now); err != nil {
+		log.Printf("SaveDraft: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Status    string    `json:"status"`
+		UpdatedAt time.Time `json:"updatedAt"`
+	}{
+		Status:    "saved",
+		UpdatedAt: now,
+	})
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"sort"
+	"wasa-project/service/database"
+	"wasa-project/service/richtext"
+)
+
+// parseMessageText turns the text written by the user into the plain text and the formatting stored with the message
+func parseMessageText(src string) (string, []database.TextEntity, error) {
+	text, entities, err := richtext.Parse(src)
+	if err != nil {
+		return "", nil, err
+	}
+	out := make([]database.TextEntity, 0, len(entities))
+	for _, e := range entities {
+		out = append(out, database.TextEntity{
+			Type:     e.Type,
+			Offset:   e.Offset,
+			Length:   e.Length,
+			URL:      e.URL,
+			Language: e.Language,
+		})
+	}
+	return text, out, nil
+}
+
+// outsideCode drops the mentions written inside inline code or code blocks
+func outsideCode(mentions []database.Mention, entities []database.TextEntity) []database.Mention {
+	out := mentions[:0]
+	for _, m := range mentions {
+		inCode := false
+		for _, e := range entities {
+			if (e.Type == richtext.Code || e.Type == richtext.Pre) && m.Offset >= e.Offset && m.Offset < e.Offset+e.Length {
+				inCode = true
+				break
+			}
+		}
+		if !inCode {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// messageEntities returns the formatting and the mentions of the message, sorted by offset. Mentions show the current
+// names of the mentioned users.
+func messageEntities(d *messageData, messageID int) []entityView {
+	formatting := d.entities[messageID]
+	mentions := d.mentions[messageID]
+
+	out := make([]entityView, 0, len(formatting)+len(mentions))
+	for _, e := range formatting {
+		out = append(out, entityView{
+			Type:     e.Type,
+			Offset:   e.Offset,
+			Length:   e.Length,
+			URL:      e.URL,
+			Language: e.Language,
+		})
+	}
+	for _, m := range mentions {
+		e := entityView{Type: "mention", Offset: m.Offset, Length: m.Length, UserID: m.UserID}
+		if u := d.user(m.UserID); u != nil {
+			e.Username = u.Username
+		}
+		out = append(out, e)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Offset != out[j].Offset {
+			return out[i].Offset < out[j].Offset
+		}
+		return out[i].Length > out[j].Length
+	})
+	return out
+}
@@ -11,16 +11,13 @@ import (
 	"strconv"
 	"strings"
 	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/globaltime"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 func (rt *_router) AddUserToConversation(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	authUser := authUserID(r)
-	if authUser == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	authUser := ctx.UserID
 
 	conversationID, err := strconv.Atoi(params.ByName("id"))
 	if err != nil {
@@ -72,11 +69,7 @@ func (rt *_router) AddUserToConversation(w http.ResponseWriter, r *http.Request,
 }
 
 func (rt *_router) SetGroupName(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	groupID, err := strconv.Atoi(params.ByName("id"))
 	if err != nil || groupID <= 0 {
@@ -135,11 +128,7 @@ func (rt *_router) SetGroupName(w http.ResponseWriter, r *http.Request, params h
 }
 
 func (rt *_router) SetGroupPhoto(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	groupID, err := strconv.Atoi(params.ByName("id"))
 	if err != nil || groupID <= 0 {
@@ -226,11 +215,7 @@ func (rt *_router) SetGroupPhoto(w http.ResponseWriter, r *http.Request, params
 }
 
 func (rt *_router) LeaveGroup(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	groupID, err := strconv.Atoi(params.ByName("id"))
 	if err != nil || groupID <= 0 {
@@ -269,7 +254,7 @@ func (rt *_router) LeaveGroup(w http.ResponseWriter, r *http.Request, params htt
 	}
 
 	// rimuovo la membership
-	removed, err := rt.db.RemoveUserFromConversation(groupID, uid)
+	removed, err := rt.db.RemoveUserFromConversation(groupID, uid, globaltime.Now().UTC())
 	if err != nil {
 		log.Printf("RemoveUserFromConversation: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
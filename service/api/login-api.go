@@ -5,8 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/auth"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
 
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
@@ -14,17 +22,23 @@ import (
 
 func (rt *_router) DoLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
 	type loginRequest struct {
-		Name string `json:"name"`
-	}
-	type loginResponse struct {
-		Identifier string `json:"identifier"`
-	}
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Device   string `json:"device"`
 
+		// secondo passo, quando serve il secondo fattore
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+	}
 	var req loginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid req", http.StatusBadRequest)
 		return
 	}
+	if req.ChallengeToken != "" {
+		rt.completeSecondFactor(w, r, req.ChallengeToken, req.Code, req.Device)
+		return
+	}
 	if len(req.Name) < 3 || len(req.Name) > 16 {
 		http.Error(w, "invalid name len", http.StatusBadRequest)
 		return
@@ -35,13 +49,45 @@ func (rt *_router) DoLogin(w http.ResponseWriter, r *http.Request, _ httprouter.
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	if err == nil && u != nil && u.Kind == database.UserKindBot {
+		// i bot entrano solo con le chiavi API
+		http.Error(w, "Forbidden: bot accounts use API keys", http.StatusForbidden)
+		return
+	}
 	if err == nil && u != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		_ = json.NewEncoder(w).Encode(loginResponse{Identifier: u.ID})
+		// account rivendicato: serve la password (se la modalità è attiva)
+		if !rt.checkLoginPassword(w, u.ID, req.Password) {
+			return
+		}
+		// con il secondo fattore attivo la sessione arriva solo dopo il codice
+		t, err := rt.db.GetTOTP(u.ID)
+		if err != nil {
+			log.Printf("GetTOTP: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if t.Enabled {
+			rt.writeChallenge(w, u.ID)
+			return
+		}
+		rt.writeSession(w, r, u.ID, req.Device)
 		return
 	}
 
+	// la password è opzionale anche alla creazione: se c'è, l'account nasce già rivendicato
+	var hash string
+	if req.Password != "" {
+		hash, err = auth.HashPassword(req.Password)
+		if errors.Is(err, auth.ErrPasswordLength) {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("HashPassword: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	newID, err := uuid.NewV4()
 	if err != nil {
 		log.Println("failed to generate uuid:", err)
@@ -54,8 +100,146 @@ func (rt *_router) DoLogin(w http.ResponseWriter, r *http.Request, _ httprouter.
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	if hash != "" {
+		if err := rt.db.SetUserPassword(newID.String(), hash); err != nil {
+			log.Printf("SetUserPassword: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rt.writeSession(w, r, newID.String(), req.Device)
+}
+
+// checkLoginPassword verifies the password of a claimed account, enforcing the lockout after repeated failures. It
+// writes the error response and returns false if the login must not proceed. Accounts linked to the identity provider
+// can't log in with the username unless they have a password, which is then always required. Unclaimed accounts, or
+// all the other accounts when passwords are not required, always pass.
+func (rt *_router) checkLoginPassword(w http.ResponseWriter, userID, password string) bool {
+	creds, err := rt.db.GetUserCredentials(userID)
+	if err != nil {
+		log.Printf("GetUserCredentials: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	// gli account collegati a un identity provider sono rivendicati anche senza password, in entrambe le modalità
+	linked, err := rt.db.HasIdentity(userID)
+	if err != nil {
+		log.Printf("HasIdentity: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if linked && creds.PasswordHash == nil {
+		http.Error(w, "Forbidden: use single sign-on for this account", http.StatusForbidden)
+		return false
+	}
+	if !linked && !rt.requirePasswords || creds.PasswordHash == nil {
+		return true
+	}
+
+	now := globaltime.Now().UTC()
+	if isLocked(w, creds, now) {
+		return false
+	}
+
+	if !auth.CheckPassword(*creds.PasswordHash, password) {
+		if err := rt.db.RecordLoginFailure(userID, rt.maxLoginFailures, now.Add(rt.loginLockout)); err != nil {
+			log.Printf("RecordLoginFailure: %v", err)
+		}
+		http.Error(w, "Not authorized: invalid credentials", http.StatusUnauthorized)
+		return false
+	}
+
+	if creds.FailedLogins > 0 || creds.LockedUntil != nil {
+		if err := rt.db.ResetLoginFailures(userID); err != nil {
+			log.Printf("ResetLoginFailures: %v", err)
+		}
+	}
+	return true
+}
+
+// isLocked writes a 403 with Retry-After and returns true if the account is temporarily locked
+func isLocked(w http.ResponseWriter, creds *database.Credentials, now time.Time) bool {
+	if creds.LockedUntil == nil || !creds.LockedUntil.After(now) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(creds.LockedUntil.Sub(now).Seconds()))))
+	http.Error(w, "Forbidden: account temporarily locked", http.StatusForbidden)
+	return true
+}
+
+// writeSession opens a new server-side session for the user, issues its token and writes the login response
+func (rt *_router) writeSession(w http.ResponseWriter, r *http.Request, userID, device string) {
+	type loginResponse struct {
+		Identifier string    `json:"identifier"`
+		UserID     string    `json:"userId"`
+		SessionID  string    `json:"sessionId"`
+		ExpiresAt  time.Time `json:"expiresAt"`
+	}
+
+	sid, err := uuid.NewV4()
+	if err != nil {
+		log.Println("failed to generate uuid:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	token, claims, err := rt.tokens.Issue(userID, sid.String())
+	if err != nil {
+		log.Printf("Issue token: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// nome del device: quello dichiarato dal client, altrimenti lo user agent
+	device = strings.TrimSpace(device)
+	if device == "" {
+		device = r.UserAgent()
+	}
+	device = truncateRunes(device, maxDeviceNameLen)
+
+	now := globaltime.Now().UTC()
+	err = rt.db.CreateSession(database.Session{
+		ID:         sid.String(),
+		UserID:     userID,
+		Device:     device,
+		IP:         remoteIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  claims.Expiry(),
+	})
+	if err != nil {
+		log.Printf("CreateSession: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(loginResponse{Identifier: newID.String()})
+	_ = json.NewEncoder(w).Encode(loginResponse{
+		Identifier: token,
+		UserID:     userID,
+		SessionID:  sid.String(),
+		ExpiresAt:  claims.Expiry(),
+	})
+}
+
+const maxDeviceNameLen = 64
+
+// remoteIP returns the IP address of the client, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// truncateRunes cuts s to at most n characters, without splitting multi-byte characters
+func truncateRunes(s string, n int) string {
+	rs := []rune(s)
+	if len(rs) <= n {
+		return s
+	}
+	return string(rs[:n])
 }
@@ -11,16 +11,14 @@ import (
 	"path/filepath"
 	"strings"
 	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/auth"
+	"wasa-project/service/globaltime"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 func (rt *_router) SetMyUserName(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	type reqBody struct {
 		Name string `json:"name"`
@@ -36,17 +34,6 @@ func (rt *_router) SetMyUserName(w http.ResponseWriter, r *http.Request, _ httpr
 		return
 	}
 
-	// 404 se il bearer non mappa a un utente
-	if _, err := rt.db.GetUserByID(uid); err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Not found", http.StatusNotFound)
-			return
-		}
-		log.Printf("GetUserByID: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-
 	// unicità --> nome usato da un altro utente -> 400
 	if u, err := rt.db.GetUserByUsername(newName); err == nil && u != nil && u.ID != uid {
 		http.Error(w, "Bad request: name already taken", http.StatusBadRequest)
@@ -69,22 +56,7 @@ func (rt *_router) SetMyUserName(w http.ResponseWriter, r *http.Request, _ httpr
 }
 
 func (rt *_router) SetMyPhoto(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-
-	// 404 se l'utente non esiste
-	if _, err := rt.db.GetUserByID(uid); err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Not found", http.StatusNotFound)
-			return
-		}
-		log.Printf("GetUserByID: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
+	uid := ctx.UserID
 
 	// parse multipart
 	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
@@ -148,32 +120,53 @@ func (rt *_router) GetMyConversations(w http.ResponseWriter, r *http.Request, _
 		Name            string  `json:"name"`
 		IsGroup         bool    `json:"isGroup"`
 		LastMessageText *string `json:"lastMessageText,omitempty"`
+		LastPhoto       bool    `json:"lastMessageIsPhoto,omitempty"`
 		LastMessageAt   *string `json:"lastMessageAt,omitempty"`
 		PhotoURL        *string `json:"photoUrl,omitempty"`
+		MentionCount    int     `json:"mentionCount"`
+		// la lista può mostrare la bozza al posto dell'ultimo messaggio
+		Draft *draftView `json:"draft,omitempty"`
 	}
 
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
-	convs, err := rt.db.GetMyConversations(uid)
+	convs, err := rt.db.GetMyConversations(uid, globaltime.Now().UTC())
 	if err != nil {
 		log.Printf("GetMyConversations: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
+	// la lista mostra l'ultimo messaggio: vale come consegna (le chiavi API solo per le loro conversazioni)
+	now := globaltime.Now().UTC()
+	if ctx.APIKey == nil || len(ctx.APIKey.ConversationIDs) == 0 {
+		if err := rt.db.MarkDelivered(uid, 0, now); err != nil {
+			log.Printf("MarkDelivered: %v", err)
+		}
+	} else {
+		for _, convID := range ctx.APIKey.ConversationIDs {
+			if err := rt.db.MarkDelivered(uid, convID, now); err != nil {
+				log.Printf("MarkDelivered: %v", err)
+			}
+		}
+	}
+
 	out := make([]item, 0, len(convs))
 	for _, c := range convs {
+		// le chiavi API vedono solo le conversazioni a cui sono limitate
+		if !ctx.CanAccessConversation(c.ID) {
+			continue
+		}
 		out = append(out, item{
 			ID:              c.ID,
 			Name:            c.Name,
 			IsGroup:         c.IsGroup,
 			LastMessageText: c.LastText,
+			LastPhoto:       c.LastPhoto,
 			LastMessageAt:   c.LastAtISO,
 			PhotoURL:        c.Photo,
+			MentionCount:    c.Mentions,
+			Draft:           draftPreview(c.Draft),
 		})
 	}
 
@@ -182,11 +175,6 @@ func (rt *_router) GetMyConversations(w http.ResponseWriter, r *http.Request, _
 }
 
 func (rt *_router) GetUserByID(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	if authUserID(r) == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-
 	id := params.ByName("id")
 
 	user, err := rt.db.GetUserByID(id)
@@ -210,30 +198,13 @@ func (rt *_router) GetUserByID(w http.ResponseWriter, r *http.Request, params ht
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
-func authUserID(r *http.Request) string {
-	raw := strings.TrimSpace(r.Header.Get("Authorization"))
-	if raw == "" {
-		return ""
-	}
-	const p = "Bearer "
-	if len(raw) >= len(p) && strings.HasPrefix(raw, p) {
-		return strings.TrimSpace(raw[len(p):])
-	}
-	return raw
-}
-
 func (rt *_router) SearchUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-
 	query := strings.TrimSpace(r.URL.Query().Get("q"))
 
 	users, err := rt.db.ListUsers(query)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		log.Printf("ListUsers: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
@@ -255,3 +226,66 @@ func (rt *_router) SearchUsers(w http.ResponseWriter, r *http.Request, _ httprou
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(resp)
 }
+
+// SetMyPassword claims the account of the caller with a password, or changes it. Changing an existing password requires
+// the current one: wrong attempts count towards the same lockout as the login, and on success the other sessions of
+// the caller are revoked.
+func (rt *_router) SetMyPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	type reqBody struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	var req reqBody
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	creds, err := rt.db.GetUserCredentials(uid)
+	if err != nil {
+		log.Printf("GetUserCredentials: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	now := globaltime.Now().UTC()
+	if creds.PasswordHash != nil {
+		if isLocked(w, creds, now) {
+			return
+		}
+		// 403 se la password attuale non corrisponde
+		if !auth.CheckPassword(*creds.PasswordHash, req.CurrentPassword) {
+			if err := rt.db.RecordLoginFailure(uid, rt.maxLoginFailures, now.Add(rt.loginLockout)); err != nil {
+				log.Printf("RecordLoginFailure: %v", err)
+			}
+			http.Error(w, "Forbidden: wrong current password", http.StatusForbidden)
+			return
+		}
+	}
+
+	hash, err := auth.HashPassword(req.NewPassword)
+	if errors.Is(err, auth.ErrPasswordLength) {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("HashPassword: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := rt.db.SetUserPassword(uid, hash); err != nil {
+		log.Printf("SetUserPassword: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// chi conosceva la vecchia password non deve restare collegato altrove
+	if _, err := rt.db.RevokeOtherSessions(uid, ctx.SessionID, now); err != nil {
+		log.Printf("RevokeOtherSessions: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "Password updated"})
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Page size of GET /me/mentions
+const (
+	defaultMentionsPage = 50
+	maxMentionsPage     = 100
+)
+
+// mentionToken is an "@username" found in a text. Offset and length are in UTF-16 code units, like the indexes of
+// JavaScript strings, and include the "@".
+type mentionToken struct {
+	name   string
+	offset int
+	length int
+}
+
+// isNameRune reports whether r can be part of a word: a mention must not be preceded or followed by one
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// utf16Len returns the length of s in UTF-16 code units
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// findMentions returns the "@username" tokens of the text that name one of the given users
+func findMentions(text string, names []string) []mentionToken {
+	// i nomi più lunghi prima, così "@anna maria" non diventa "@anna"
+	sorted := append([]string(nil), names...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	var out []mentionToken
+	pos := 0
+	prev := rune(0)
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r == '@' && !isNameRune(prev) {
+			rest := text[i+1:]
+			found := ""
+			for _, n := range sorted {
+				if n == "" || !strings.HasPrefix(rest, n) {
+					continue
+				}
+				next, _ := utf8.DecodeRuneInString(rest[len(n):])
+				if len(rest) == len(n) || !isNameRune(next) {
+					found = n
+					break
+				}
+			}
+			if found != "" {
+				l := 1 + utf16Len(found)
+				out = append(out, mentionToken{name: found, offset: pos, length: l})
+				pos += l
+				i += 1 + len(found)
+				prev, _ = utf8.DecodeLastRuneInString(found)
+				continue
+			}
+		}
+		pos += utf16Len(text[i : i+size])
+		prev = r
+		i += size
+	}
+	return out
+}
+
+// resolveMentions returns the members of the conversation mentioned in the text. The sender mentioning themselves
+// doesn't count.
+func (rt *_router) resolveMentions(conversationID int, senderID, text string) ([]database.Mention, error) {
+	if !strings.Contains(text, "@") {
+		return nil, nil
+	}
+	names, err := rt.db.GetConversationParticipants(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []database.Mention
+	ids := make(map[string]string)
+	for _, t := range findMentions(text, names) {
+		id, ok := ids[t.name]
+		if !ok {
+			u, err := rt.db.GetUserByUsername(t.name)
+			if err == sql.ErrNoRows {
+				// rinominato nel frattempo
+				ids[t.name] = ""
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			id = u.ID
+			ids[t.name] = id
+		}
+		if id == "" || id == senderID {
+			continue
+		}
+		out = append(out, database.Mention{UserID: id, Offset: t.offset, Length: t.length})
+	}
+	return out, nil
+}
+
+// insertMessage saves a new message, whose text and formatting were already parsed, together with the members it
+// mentions and the links to preview
+func (rt *_router) insertMessage(msg database.NewMessage) (int, error) {
+	if err := rt.addMentionsAndLinks(&msg); err != nil {
+		return 0, err
+	}
+	return rt.db.InsertMessage(msg, globaltime.Now().UTC())
+}
+
+// addMentionsAndLinks fills in the members mentioned by the message and the links to preview
+func (rt *_router) addMentionsAndLinks(msg *database.NewMessage) error {
+	mentions, err := rt.resolveMentions(msg.ConversationID, msg.SenderID, msg.Text)
+	if err != nil {
+		return err
+	}
+	msg.Mentions = outsideCode(mentions, msg.Entities)
+	msg.Links = rt.messageLinks(msg.Text, msg.Entities)
+	return nil
+}
+
+// mentionView is a message that mentions the caller, with the conversation it belongs to
+type mentionView struct {
+	ConversationID   int     `json:"conversationId"`
+	ConversationName string  `json:"conversationName"`
+	Read             bool    `json:"read"`
+	Message          msgView `json:"message"`
+}
+
+// GetMyMentions returns a page of the messages that mention the caller, newest first. The next page starts before the
+// message in nextBefore, which is missing on the last page.
+func (rt *_router) GetMyMentions(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	q := r.URL.Query()
+	limit := defaultMentionsPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxMentionsPage)
+	}
+	before := 0
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+
+	// una riga in più per sapere se c'è un'altra pagina
+	now := globaltime.Now().UTC()
+	mentions, err := rt.db.ListMentions(uid, before, limit+1, now)
+	if err != nil {
+		log.Printf("ListMentions: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var nextBefore *int
+	if len(mentions) > limit {
+		mentions = mentions[:limit]
+		nextBefore = &mentions[limit-1].MessageID
+	}
+
+	data := make(map[int]*messageData)
+	out := make([]mentionView, 0, len(mentions))
+	for _, mn := range mentions {
+		// le chiavi API vedono solo le conversazioni a cui sono limitate
+		if !ctx.CanAccessConversation(mn.ConversationID) {
+			continue
+		}
+		if _, ok := data[mn.ConversationID]; !ok {
+			if data[mn.ConversationID], err = rt.loadMessageData(mn.ConversationID, now); err != nil {
+				log.Printf("loadMessageData: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		m, err := rt.db.GetMessageByID(mn.MessageID)
+		if err != nil {
+			log.Printf("GetMessageByID: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, mentionView{
+			ConversationID:   mn.ConversationID,
+			ConversationName: mn.ConversationName,
+			Read:             mn.Read,
+			Message:          rt.messageView(*m, uid, data[mn.ConversationID]),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Mentions   []mentionView `json:"mentions"`
+		NextBefore *int          `json:"nextBefore,omitempty"`
+	}{
+		Mentions:   out,
+		NextBefore: nextBefore,
+	})
+}
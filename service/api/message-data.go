@@ -0,0 +1,73 @@
+package api
+
+import (
+	"time"
+	"wasa-project/service/database"
+)
+
+// messageData is what the views of the messages of a conversation need besides the messages themselves: it's read
+// once for the whole conversation, so that building the view of each message doesn't query the database again
+type messageData struct {
+	db database.AppDatabase
+
+	receipts  map[int]database.ReceiptSummary
+	threads   map[int]database.ThreadSummary
+	reactions map[int][]database.Reaction
+	entities  map[int][]database.TextEntity
+	mentions  map[int][]database.Mention
+	previews  map[int][]database.LinkPreview
+	polls     map[int]*database.Poll
+	quoted    map[int]database.Message
+
+	// users sono letti solo la prima volta che servono
+	users map[string]*database.User
+}
+
+// loadMessageData reads the data of the messages of the conversation, at the given time
+func (rt *_router) loadMessageData(convID int, now time.Time) (*messageData, error) {
+	d := &messageData{db: rt.db, users: make(map[string]*database.User)}
+	var err error
+	if d.receipts, err = rt.db.GetReceiptSummaries(convID); err != nil {
+		return nil, err
+	}
+	if d.threads, err = rt.db.GetThreadSummaries(convID, now); err != nil {
+		return nil, err
+	}
+	if d.reactions, err = rt.db.ListConversationReactions(convID); err != nil {
+		return nil, err
+	}
+	if d.entities, err = rt.db.ListConversationEntities(convID); err != nil {
+		return nil, err
+	}
+	if d.mentions, err = rt.db.ListConversationMentions(convID); err != nil {
+		return nil, err
+	}
+	if d.previews, err = rt.db.ListConversationPreviews(convID); err != nil {
+		return nil, err
+	}
+	if d.polls, err = rt.db.ListConversationPolls(convID); err != nil {
+		return nil, err
+	}
+	if d.quoted, err = rt.db.ListQuotedMessages(convID); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// user returns the user, or nil if it can't be read
+func (d *messageData) user(id string) *database.User {
+	u, ok := d.users[id]
+	if !ok {
+		u, _ = d.db.GetUserByID(id)
+		d.users[id] = u
+	}
+	return u
+}
+
+// username returns the username of the user, or the ID if the user can't be read
+func (d *messageData) username(id string) string {
+	if u := d.user(id); u != nil {
+		return u.Username
+	}
+	return id
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/gofrs/uuid"
+)
+
+// maxMessageLength is the maximum length of the text of a message, in characters
+const maxMessageLength = 4096
+
+// messageRequest is the body of the endpoints that send a message. It's sent as JSON, or as multipart/form-data with
+// the same field names when a photo is attached (in the "photo" part). With a photo the text is the caption, and it can
+// be empty. With scheduledAt the message is sent later, at that time.
+type messageRequest struct {
+	ToUserID         string     `json:"toUserId"`
+	Text             string     `json:"text"`
+	ReplyToMessageID int        `json:"replyToMessageId"`
+	ScheduledAt      *time.Time `json:"scheduledAt"`
+
+	photo    []byte
+	photoExt string
+	// text ed entities sono Text già formattato
+	text     string
+	entities []database.TextEntity
+}
+
+// decodeMessageRequest reads the message from the request body. It writes a 400 and returns false if the body is not
+// valid, or if the message has neither text nor photo.
+func decodeMessageRequest(w http.ResponseWriter, r *http.Request) (*messageRequest, bool) {
+	var req messageRequest
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return nil, false
+		}
+		req.ToUserID = r.FormValue("toUserId")
+		req.Text = r.FormValue("text")
+		if v := r.FormValue("replyToMessageId"); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return nil, false
+			}
+			req.ReplyToMessageID = id
+		}
+		if v := r.FormValue("scheduledAt"); v != "" {
+			at, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return nil, false
+			}
+			req.ScheduledAt = &at
+		}
+
+		file, _, err := r.FormFile("photo")
+		if err != nil && !errors.Is(err, http.ErrMissingFile) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return nil, false
+		}
+		if err == nil {
+			defer file.Close()
+
+			lr := &io.LimitedReader{R: file, N: maxUploadSize + 1}
+			data, err := io.ReadAll(lr)
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return nil, false
+			}
+			if int64(len(data)) > maxUploadSize {
+				http.Error(w, "Bad request: file too large", http.StatusBadRequest)
+				return nil, false
+			}
+			ext, ok := detectImageExt(data)
+			if !ok {
+				http.Error(w, "Bad request: unsupported image type", http.StatusBadRequest)
+				return nil, false
+			}
+			req.photo, req.photoExt = data, ext
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if strings.TrimSpace(req.Text) == "" && req.photo == nil || req.ReplyToMessageID < 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, false
+	}
+	if utf8.RuneCountInString(req.Text) > maxMessageLength {
+		http.Error(w, "Bad request: text too long", http.StatusBadRequest)
+		return nil, false
+	}
+	text, entities, err := parseMessageText(req.Text)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req.text, req.entities = text, entities
+	if req.ScheduledAt != nil && !req.ScheduledAt.After(globaltime.Now()) {
+		http.Error(w, "Bad request: scheduledAt must be in the future", http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+// message returns the message to save for the request. A scheduled message keeps the text as written by the user,
+// and it's formatted when it's sent.
+func (req *messageRequest) message(conversationID int, senderID string, photo *string) database.NewMessage {
+	msg := database.NewMessage{
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		Text:           req.text,
+		Entities:       req.entities,
+		Photo:          photo,
+		ReplyToID:      req.replyTo(),
+	}
+	if req.ScheduledAt != nil {
+		msg.Text, msg.Entities = req.Text, nil
+	}
+	return msg
+}
+
+// replyTo returns the ID of the quoted message, or nil
+func (req *messageRequest) replyTo() *int {
+	if req.ReplyToMessageID == 0 {
+		return nil
+	}
+	id := req.ReplyToMessageID
+	return &id
+}
+
+// checkReplyTo writes a 400 and returns false if the message quoted by the request is not in the conversation
+func (rt *_router) checkReplyTo(w http.ResponseWriter, req *messageRequest, conversationID int) bool {
+	if req.ReplyToMessageID == 0 {
+		return true
+	}
+	quoted, err := rt.db.GetMessageByID(req.ReplyToMessageID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if err != nil || quoted.ConversationID != conversationID || removed(quoted, globaltime.Now()) {
+		http.Error(w, "Bad request: replyToMessageId is not a message of this conversation", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// storeMessagePhoto saves the photo of the message under uploads/messages and returns its URL, or nil if the message
+// has no photo. Each photo gets a new random name, so the URL can be shared by forwarded copies.
+func storeMessagePhoto(req *messageRequest) (*string, error) {
+	if req.photo == nil {
+		return nil, nil
+	}
+	name, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll("uploads/messages", 0o755); err != nil {
+		return nil, err
+	}
+	dstFS := filepath.Join("uploads", "messages", name.String()+req.photoExt)
+	if err := os.WriteFile(dstFS, req.photo, 0o644); err != nil {
+		return nil, err
+	}
+	url := "/uploads/messages/" + name.String() + req.photoExt
+	return &url, nil
+}
+
+// removeUpload deletes the file behind an /uploads URL, e.g. when the message it belonged to could not be saved
+func removeUpload(url string) {
+	rel := strings.TrimPrefix(url, "/")
+	if !strings.HasPrefix(rel, "uploads/") {
+		return
+	}
+	if err := os.Remove(filepath.FromSlash(rel)); err != nil && !os.IsNotExist(err) {
+		log.Printf("removeUpload(%s): %v", url, err)
+	}
+}
@@ -7,31 +7,30 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/emoji"
+	"wasa-project/service/globaltime"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 func (rt *_router) SendDirectMessage(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
-	type reqBody struct {
-		ToUserID string `json:"toUserId"`
-		Text     string `json:"text"`
-	}
 	type respBody struct {
 		ConversationID int    `json:"conversationId"`
 		MessageID      int    `json:"messageId"`
 		Status         string `json:"status"`
 	}
 
-	senderID := authUserID(r)
-	if strings.TrimSpace(senderID) == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
+	senderID := ctx.UserID
+
+	req, ok := decodeMessageRequest(w, r)
+	if !ok {
 		return
 	}
-
-	var req reqBody
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
-		strings.TrimSpace(req.ToUserID) == "" || strings.TrimSpace(req.Text) == "" {
+	if strings.TrimSpace(req.ToUserID) == "" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
@@ -51,7 +50,11 @@ func (rt *_router) SendDirectMessage(w http.ResponseWriter, r *http.Request, _ h
 	}
 
 	convID, err := rt.db.FindDirectConversation(senderID, req.ToUserID)
-	if err == sql.ErrNoRows {
+	if err == sql.ErrNoRows && req.ReplyToMessageID != 0 {
+		// una conversazione nuova non ha messaggi da citare
+		http.Error(w, "Bad request: replyToMessageId is not a message of this conversation", http.StatusBadRequest)
+		return
+	} else if err == sql.ErrNoRows {
 		convID, err = rt.db.CreateDirectConversation(senderID, req.ToUserID, "")
 		if err != nil {
 			log.Printf("CreateDirectConversation: %v", err)
@@ -64,12 +67,32 @@ func (rt *_router) SendDirectMessage(w http.ResponseWriter, r *http.Request, _ h
 		return
 	}
 
-	msgID, err := rt.db.InsertMessage(convID, senderID, req.Text)
+	if !rt.checkReplyTo(w, req, convID) {
+		return
+	}
+
+	photo, err := storeMessagePhoto(req)
+	if err != nil {
+		log.Printf("storeMessagePhoto: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	msg := req.message(convID, senderID, photo)
+	if req.ScheduledAt != nil {
+		rt.scheduleMessage(w, msg, *req.ScheduledAt)
+		return
+	}
+
+	msgID, err := rt.insertMessage(msg)
 	if err != nil {
 		log.Printf("InsertMessage: %v", err)
+		if photo != nil {
+			removeUpload(*photo)
+		}
 		http.Error(w, "failed to send message", http.StatusInternalServerError)
 		return
 	}
+	rt.clearDraft(convID, senderID)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -80,16 +103,17 @@ func (rt *_router) SendDirectMessage(w http.ResponseWriter, r *http.Request, _ h
 	})
 }
 
+// removed reports whether the message was deleted for everyone or has expired at the given time
+func removed(m *database.Message, now time.Time) bool {
+	return m.DeletedAt != nil || m.ExpiresAt != nil && !m.ExpiresAt.After(now)
+}
+
 func (rt *_router) ForwardMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
 	type reqBody struct {
 		ConversationID int `json:"conversationId"`
 	}
 
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	msgIDStr := params.ByName("id")
 	msgID, err := strconv.Atoi(msgIDStr)
@@ -129,12 +153,12 @@ func (rt *_router) ForwardMessage(w http.ResponseWriter, r *http.Request, params
 	}
 
 	// messaggio sorgente -> load + mship nella conversazione sorgente
+	now := globaltime.Now().UTC()
 	srcMsg, err := rt.db.GetMessageByID(msgID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Not found", http.StatusNotFound)
-			return
-		}
+	if err == sql.ErrNoRows || (err == nil && removed(srcMsg, now)) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		log.Printf("GetMessageByID: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -147,9 +171,44 @@ func (rt *_router) ForwardMessage(w http.ResponseWriter, r *http.Request, params
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
+	if !rt.refusePoll(w, srcMsg.ID, "forwarded") {
+		return
+	}
+
+	// la provenienza è quella del primo messaggio della catena
+	origID, origSender, origAt := srcMsg.ID, srcMsg.SenderID, srcMsg.Timestamp
+	if srcMsg.ForwardedFromID != nil {
+		origID = *srcMsg.ForwardedFromID
+		if srcMsg.ForwardedSenderID != nil {
+			origSender = *srcMsg.ForwardedSenderID
+		}
+		if srcMsg.ForwardedAt != nil {
+			origAt = *srcMsg.ForwardedAt
+		}
+	}
+
+	// la formattazione resta, le menzioni no (sono della conversazione sorgente)
+	entities, err := rt.db.ListMessageEntities(srcMsg.ID)
+	if err != nil {
+		log.Printf("ListMessageEntities: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
 
-	// inserisco il messaggio nella destinazione
-	if _, err := rt.db.InsertMessage(dstConvID, uid, srcMsg.Text); err != nil {
+	// inserisco il messaggio nella destinazione (la foto è condivisa con l'originale)
+	_, err = rt.db.InsertMessage(database.NewMessage{
+		ConversationID:    dstConvID,
+		SenderID:          uid,
+		Text:              srcMsg.Text,
+		Entities:          entities,
+		Links:             rt.messageLinks(srcMsg.Text, entities),
+		Photo:             srcMsg.Photo,
+		ForwardedFromID:   &origID,
+		ForwardedSenderID: &origSender,
+		ForwardedAt:       &origAt,
+		ForwardCount:      srcMsg.ForwardCount + 1,
+	}, now)
+	if err != nil {
 		log.Printf("InsertMessage(forward): %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -160,11 +219,7 @@ func (rt *_router) ForwardMessage(w http.ResponseWriter, r *http.Request, params
 }
 
 func (rt *_router) CommentMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	msgID, err := strconv.Atoi(params.ByName("id"))
 	if err != nil || msgID <= 0 {
@@ -177,18 +232,17 @@ func (rt *_router) CommentMessage(w http.ResponseWriter, r *http.Request, params
 	}
 
 	var body req
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Comment) == "" {
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !emoji.IsSingle(body.Comment) {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
 
-	// 404 se il messaggio non esiste
+	// 404 se il messaggio non esiste (o è stato cancellato o è scaduto)
 	m, err := rt.db.GetMessageByID(msgID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Not found", http.StatusNotFound)
-			return
-		}
+	if err == sql.ErrNoRows || (err == nil && removed(m, globaltime.Now())) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		log.Printf("GetMessageByID: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -206,9 +260,10 @@ func (rt *_router) CommentMessage(w http.ResponseWriter, r *http.Request, params
 		return
 	}
 
-	cmtID, err := rt.db.UpsertComment(msgID, uid, body.Comment)
+	// il vecchio commento vale come unica reazione dell'utente
+	cmtID, err := rt.db.SetReaction(msgID, uid, body.Comment, globaltime.Now().UTC())
 	if err != nil {
-		log.Printf("UpsertComment: %v", err)
+		log.Printf("SetReaction: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
@@ -224,11 +279,7 @@ func (rt *_router) CommentMessage(w http.ResponseWriter, r *http.Request, params
 }
 
 func (rt *_router) UncommentMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	msgID, err := strconv.Atoi(params.ByName("id"))
 	if err != nil || msgID <= 0 {
@@ -236,13 +287,12 @@ func (rt *_router) UncommentMessage(w http.ResponseWriter, r *http.Request, para
 		return
 	}
 
-	// 404 se il messaggio non esiste
+	// 404 se il messaggio non esiste (o è stato cancellato o è scaduto)
 	m, err := rt.db.GetMessageByID(msgID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Not found", http.StatusNotFound)
-			return
-		}
+	if err == sql.ErrNoRows || (err == nil && removed(m, globaltime.Now())) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		log.Printf("GetMessageByID: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -260,9 +310,9 @@ func (rt *_router) UncommentMessage(w http.ResponseWriter, r *http.Request, para
 		return
 	}
 
-	removed, err := rt.db.DeleteComment(msgID, uid)
+	removed, err := rt.db.RemoveReaction(msgID, uid, "")
 	if err != nil {
-		log.Printf("DeleteComment: %v", err)
+		log.Printf("RemoveReaction: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
@@ -276,12 +326,10 @@ func (rt *_router) UncommentMessage(w http.ResponseWriter, r *http.Request, para
 	_ = json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
 }
 
+// DeleteMessage deletes a message for everyone (only the author, leaving a tombstone) or, with scope=me, only for the
+// caller (any member of the conversation)
 func (rt *_router) DeleteMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
-	uid := authUserID(r)
-	if uid == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
+	uid := ctx.UserID
 
 	msgIDStr := params.ByName("id")
 	msgID, err := strconv.Atoi(msgIDStr)
@@ -289,36 +337,210 @@ func (rt *_router) DeleteMessage(w http.ResponseWriter, r *http.Request, params
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = "everyone"
+	}
+	if scope != "everyone" && scope != "me" {
+		http.Error(w, "Bad request: scope must be \"everyone\" or \"me\"", http.StatusBadRequest)
+		return
+	}
 
-	// tentativo di cancellazione: id + author
-	deleted, err := rt.db.DeleteMessage(msgID, uid)
+	m, err := rt.db.GetMessageByID(msgID)
 	if err != nil {
-		log.Printf("DeleteMessage: %v", err)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("GetMessageByID: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	if !deleted {
-		// on è stato cancellato nulla: distingui 404 vs 403
-		m, err := rt.db.GetMessageByID(msgID)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Not found", http.StatusNotFound)
-				return
-			}
-			log.Printf("GetMessageByID: %v", err)
+	ok, err := rt.db.IsUserInConversation(m.ConversationID, uid)
+	if err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	now := globaltime.Now().UTC()
+
+	if scope == "me" {
+		if err := rt.db.HideMessage(msgID, uid, now); err != nil {
+			log.Printf("HideMessage: %v", err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		// esiste ma non sei l'autore
-		if m.SenderID != uid {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
-		// in teoria qui non si arriva
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "hidden"})
+		return
+	}
+
+	// per tutti solo l'autore
+	if m.SenderID != uid {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	deleted, err := rt.db.DeleteMessage(msgID, uid, now)
+	if err != nil {
+		log.Printf("DeleteMessage: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	if !deleted {
+		// già cancellato
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
 }
+
+func (rt *_router) EditMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	msgID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || msgID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	m, err := rt.db.GetMessageByID(msgID)
+	if err == sql.ErrNoRows || (err == nil && removed(m, globaltime.Now())) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// solo l'autore può modificare
+	if m.SenderID != uid {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	now := globaltime.Now().UTC()
+	if rt.editWindow > 0 && now.Sub(m.Timestamp) > rt.editWindow {
+		http.Error(w, "Forbidden: the message can't be edited anymore", http.StatusForbidden)
+		return
+	}
+	// il testo può essere vuoto solo per le foto (didascalia)
+	if strings.TrimSpace(req.Text) == "" && m.Photo == nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(req.Text) > maxMessageLength {
+		http.Error(w, "Bad request: text too long", http.StatusBadRequest)
+		return
+	}
+	if !rt.refusePoll(w, msgID, "edited") {
+		return
+	}
+
+	text, entities, err := parseMessageText(req.Text)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// le menzioni seguono il nuovo testo
+	mentions, err := rt.resolveMentions(m.ConversationID, uid, text)
+	if err != nil {
+		log.Printf("resolveMentions: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	edited, err := rt.db.EditMessage(msgID, uid, text, entities, outsideCode(mentions, entities),
+		rt.messageLinks(text, entities), now)
+	if err != nil {
+		log.Printf("EditMessage: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !edited {
+		// cancellato nel frattempo
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Status   string    `json:"status"`
+		EditedAt time.Time `json:"editedAt"`
+	}{
+		Status:   "edited",
+		EditedAt: now,
+	})
+}
+
+// GetMessageHistory returns the previous versions of a message to the members of its conversation
+func (rt *_router) GetMessageHistory(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	msgID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || msgID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	m, err := rt.db.GetMessageByID(msgID)
+	if err == sql.ErrNoRows || (err == nil && removed(m, globaltime.Now())) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if ok, err := rt.db.IsUserInConversation(m.ConversationID, uid); err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	edits, err := rt.db.ListMessageEdits(msgID)
+	if err != nil {
+		log.Printf("ListMessageEdits: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// ogni versione è valida dalla sostituzione della precedente (la prima dall'invio)
+	type versionView struct {
+		Text      string    `json:"text"`
+		ValidFrom time.Time `json:"validFrom"`
+	}
+	versions := make([]versionView, 0, len(edits)+1)
+	from := m.Timestamp
+	for _, e := range edits {
+		versions = append(versions, versionView{Text: e.Text, ValidFrom: from})
+		from = e.ReplacedAt
+	}
+	versions = append(versions, versionView{Text: m.Text, ValidFrom: from})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		MessageID int           `json:"messageId"`
+		EditedAt  *time.Time    `json:"editedAt,omitempty"`
+		Versions  []versionView `json:"versions"`
+	}{
+		MessageID: msgID,
+		EditedAt:  m.EditedAt,
+		Versions:  versions,
+	})
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/oidc"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// oidcCookie keeps state and nonce of a login in progress, binding the callback to the browser that started it
+	oidcCookie = "wasa_oidc"
+	// oidcLoginTimeout is how long the user has to complete the login on the identity provider
+	oidcLoginTimeout = 600
+)
+
+// OIDCStart redirects the browser to the identity provider login page
+func (rt *_router) OIDCStart(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	if rt.oidc == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	state, err1 := randomToken()
+	nonce, err2 := randomToken()
+	if err1 != nil || err2 != nil {
+		log.Printf("randomToken: %v %v", err1, err2)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := rt.oidc.AuthCodeURL(r.Context(), state, nonce)
+	if err != nil {
+		log.Printf("AuthCodeURL: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce,
+		Path:     "/session/oidc",
+		MaxAge:   oidcLoginTimeout,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback completes the login started by OIDCStart: the authorization code is exchanged for the ID token, whose
+// subject is mapped to a user (created on first login). The response is the same of POST /session.
+func (rt *_router) OIDCCallback(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	if rt.oidc == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// il cookie si usa una volta sola
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Value: "", Path: "/session/oidc", MaxAge: -1, HttpOnly: true})
+
+	q := r.URL.Query()
+	if q.Get("error") != "" {
+		http.Error(w, "Not authorized: "+q.Get("error"), http.StatusUnauthorized)
+		return
+	}
+
+	// lo state deve essere quello emesso a questo browser (CSRF)
+	c, err := r.Cookie(oidcCookie)
+	if err != nil {
+		http.Error(w, "Bad request: no login in progress", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || q.Get("state") != parts[0] || q.Get("code") == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	idt, err := rt.oidc.Exchange(r.Context(), q.Get("code"), parts[1])
+	if errors.Is(err, oidc.ErrInvalidIDToken) {
+		ctx.Logger.WithError(err).Warning("OIDC login rejected")
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("OIDC Exchange: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	uid, err := rt.db.GetUserIDByIdentity(idt.Issuer, idt.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		// primo login: creo l'utente con un nome libero derivato dai claim
+		uid, err = rt.createOIDCUser(idt)
+	}
+	if err != nil {
+		log.Printf("OIDC user: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// come nel login con username, con l'autenticazione a due fattori serve prima il codice
+	t, err := rt.db.GetTOTP(uid)
+	if err != nil {
+		log.Printf("GetTOTP: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if t.Enabled {
+		rt.writeChallenge(w, uid)
+		return
+	}
+	rt.writeSession(w, r, uid, "")
+}
+
+// createOIDCUser creates the user for a new identity, with a username derived from the ID token claims. If the name is
+// taken, a numeric suffix is added.
+func (rt *_router) createOIDCUser(idt *oidc.IDToken) (string, error) {
+	newID, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	base := oidcUsername(idt)
+	name := base
+	for i := 2; ; i++ {
+		_, err := rt.db.GetUserByUsername(name)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = rt.db.CreateUserWithIdentity(newID.String(), name, idt.Issuer, idt.Subject)
+			if err == nil {
+				return newID.String(), nil
+			}
+			// qualcuno ha preso il nome nel frattempo: provo il suffisso successivo
+			if !errors.Is(err, database.ErrUsernameTaken) {
+				return "", err
+			}
+		} else if err != nil {
+			return "", err
+		}
+		if i > 1000 {
+			return "", errors.New("can't find a free username")
+		}
+		suffix := strconv.Itoa(i)
+		name = truncateBytes(base, 16-len(suffix)) + suffix
+	}
+}
+
+// oidcUsername picks the username from the ID token claims, keeping only letters, digits, '.', '-' and '_' and
+// respecting the usual 3-16 bytes length checked by the login
+func oidcUsername(idt *oidc.IDToken) string {
+	candidate := idt.PreferredUsername
+	if candidate == "" {
+		candidate = idt.Name
+	}
+	if candidate == "" {
+		candidate = strings.SplitN(idt.Email, "@", 2)[0]
+	}
+
+	var b strings.Builder
+	for _, r := range candidate {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			b.WriteRune(r)
+		}
+	}
+	name := truncateBytes(b.String(), 16)
+	if len(name) < 3 {
+		name = "user"
+	}
+	return name
+}
+
+// truncateBytes cuts s to at most n bytes, without splitting multi-byte characters
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
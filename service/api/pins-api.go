@@ -0,0 +1,152 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// pinView is a pinned message, with who pinned it and when
+type pinView struct {
+	Message  msgView   `json:"message"`
+	PinnedBy string    `json:"pinnedBy"`
+	PinnedAt time.Time `json:"pinnedAt"`
+}
+
+// pinnedViews builds the list of the messages pinned in the conversation, for the user uid
+func (rt *_router) pinnedViews(convID int, uid string, d *messageData) ([]pinView, error) {
+	pins, err := rt.db.ListPins(convID, globaltime.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]pinView, 0, len(pins))
+	for _, p := range pins {
+		m, err := rt.db.GetMessageByID(p.MessageID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pinView{
+			Message:  rt.messageView(*m, uid, d),
+			PinnedBy: d.username(p.PinnedBy),
+			PinnedAt: p.PinnedAt,
+		})
+	}
+	return out, nil
+}
+
+// memberConversation reads the conversation of the request, replying 404 if it does not exist and 403 if the caller is
+// not a member
+func (rt *_router) memberConversation(w http.ResponseWriter, params httprouter.Params, ctx reqcontext.RequestContext) (int, bool) {
+	convID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || convID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return 0, false
+	}
+
+	// 404 se non esiste
+	if _, err := rt.db.GetConversationInfo(convID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return 0, false
+		}
+		log.Printf("GetConversationInfo: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, false
+	}
+	// 403 se non sei membro
+	ok, err := rt.db.IsUserInConversation(convID, ctx.UserID)
+	if err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !ok || !ctx.CanAccessConversation(convID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	return convID, true
+}
+
+// PinMessage pins a message of the conversation
+func (rt *_router) PinMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	var body struct {
+		MessageID int `json:"messageId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.MessageID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	convID, ok := rt.memberConversation(w, params, ctx)
+	if !ok {
+		return
+	}
+
+	// 404 anche se il messaggio è di un'altra conversazione, cancellato o scaduto
+	m, err := rt.db.GetMessageByID(body.MessageID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || m.ConversationID != convID || removed(m, globaltime.Now()) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	added, err := rt.db.PinMessage(convID, m.ID, ctx.UserID, globaltime.Now().UTC(), rt.maxPins)
+	if errors.Is(err, database.ErrTooManyPins) {
+		http.Error(w, "Conflict: too many pinned messages in this conversation", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("PinMessage: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// 201 solo se non era già fissato
+	if added {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "pinned"})
+}
+
+// UnpinMessage removes the pin of a message of the conversation
+func (rt *_router) UnpinMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	msgID, err := strconv.Atoi(params.ByName("messageId"))
+	if err != nil || msgID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	convID, ok := rt.memberConversation(w, params, ctx)
+	if !ok {
+		return
+	}
+
+	removed, err := rt.db.UnpinMessage(convID, msgID)
+	if err != nil {
+		log.Printf("UnpinMessage: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		// il messaggio non era fissato -> 404
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "unpinned"})
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Limits of a poll
+const (
+	minPollOptions      = 2
+	maxPollOptions      = 10
+	maxPollQuestionLen  = 300
+	maxPollOptionLength = 100
+)
+
+// pollView is a poll with its live tallies. Voters are shown only if the poll is not anonymous.
+type pollView struct {
+	ID             int              `json:"id"`
+	Question       string           `json:"question"`
+	Options        []pollOptionView `json:"options"`
+	MultipleChoice bool             `json:"multipleChoice"`
+	Anonymous      bool             `json:"anonymous"`
+	CreatedBy      string           `json:"createdBy"`
+	ClosesAt       *time.Time       `json:"closesAt,omitempty"`
+	Closed         bool             `json:"closed"`
+	TotalVoters    int              `json:"totalVoters"`
+	MyVotes        []int            `json:"myVotes"`
+}
+
+type pollOptionView struct {
+	Text   string   `json:"text"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters,omitempty"`
+}
+
+// messagePoll builds the view of the poll of the message for the user uid, or returns nil if the message is not a poll
+func messagePoll(d *messageData, messageID int, uid string) *pollView {
+	p, ok := d.polls[messageID]
+	if !ok {
+		return nil
+	}
+
+	v := &pollView{
+		ID:             p.ID,
+		Question:       p.Question,
+		Options:        make([]pollOptionView, 0, len(p.Options)),
+		MultipleChoice: p.MultipleChoice,
+		Anonymous:      p.Anonymous,
+		CreatedBy:      d.username(p.CreatorID),
+		ClosesAt:       p.ClosesAt,
+		Closed:         p.Closed(globaltime.Now().UTC()),
+		MyVotes:        []int{},
+	}
+	voters := make(map[string]bool)
+	for i, o := range p.Options {
+		ov := pollOptionView{Text: o.Text, Votes: len(o.Voters)}
+		for _, id := range o.Voters {
+			voters[id] = true
+			if id == uid {
+				v.MyVotes = append(v.MyVotes, i)
+			}
+			if !p.Anonymous {
+				ov.Voters = append(ov.Voters, d.username(id))
+			}
+		}
+		v.Options = append(v.Options, ov)
+	}
+	v.TotalVoters = len(voters)
+	return v
+}
+
+// refusePoll replies 400 if the message is a poll, since polls can't be edited or forwarded. It returns false if it
+// replied.
+func (rt *_router) refusePoll(w http.ResponseWriter, messageID int, action string) bool {
+	_, err := rt.db.GetPollByMessage(messageID)
+	if err == sql.ErrNoRows {
+		return true
+	} else if err != nil {
+		log.Printf("GetPollByMessage: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	http.Error(w, "Bad request: a poll can't be "+action, http.StatusBadRequest)
+	return false
+}
+
+// CreatePoll sends a poll to a group conversation
+func (rt *_router) CreatePoll(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Question       string     `json:"question"`
+		Options        []string   `json:"options"`
+		MultipleChoice bool       `json:"multipleChoice"`
+		Anonymous      bool       `json:"anonymous"`
+		ClosesAt       *time.Time `json:"closesAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	now := globaltime.Now().UTC()
+	poll, msg := validatePoll(req.Question, req.Options, req.ClosesAt, now)
+	if msg != "" {
+		http.Error(w, "Bad request: "+msg, http.StatusBadRequest)
+		return
+	}
+	poll.MultipleChoice, poll.Anonymous = req.MultipleChoice, req.Anonymous
+
+	convID, ok := rt.memberConversation(w, params, ctx)
+	if !ok {
+		return
+	}
+	info, err := rt.db.GetConversationInfo(convID)
+	if err != nil {
+		log.Printf("GetConversationInfo: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// i sondaggi solo nei gruppi
+	if !info.IsGroup {
+		http.Error(w, "Bad request: Not a group conversation", http.StatusBadRequest)
+		return
+	}
+
+	pollID, msgID, err := rt.db.CreatePoll(database.NewMessage{
+		ConversationID: convID,
+		SenderID:       ctx.UserID,
+		Text:           poll.Question,
+	}, poll, now)
+	if err != nil {
+		log.Printf("CreatePoll: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(struct {
+		PollID    int    `json:"pollId"`
+		MessageID int    `json:"messageId"`
+		Status    string `json:"status"`
+	}{
+		PollID:    pollID,
+		MessageID: msgID,
+		Status:    "sent",
+	})
+}
+
+// validatePoll checks the question, the options and the close time of a new poll, and returns the poll to create or
+// the reason why it's invalid
+func validatePoll(question string, options []string, closesAt *time.Time, now time.Time) (database.NewPoll, string) {
+	question = strings.TrimSpace(question)
+	if question == "" || utf8.RuneCountInString(question) > maxPollQuestionLen {
+		return database.NewPoll{}, "the question must have 1 to " + strconv.Itoa(maxPollQuestionLen) + " characters"
+	}
+	if len(options) < minPollOptions || len(options) > maxPollOptions {
+		return database.NewPoll{}, "a poll must have " + strconv.Itoa(minPollOptions) + " to " +
+			strconv.Itoa(maxPollOptions) + " options"
+	}
+	p := database.NewPoll{Question: question, Options: make([]string, 0, len(options))}
+	seen := make(map[string]bool)
+	for _, o := range options {
+		o = strings.TrimSpace(o)
+		if o == "" || utf8.RuneCountInString(o) > maxPollOptionLength {
+			return database.NewPoll{}, "options must have 1 to " + strconv.Itoa(maxPollOptionLength) + " characters"
+		}
+		// le opzioni devono essere diverse
+		if seen[strings.ToLower(o)] {
+			return database.NewPoll{}, "duplicate option"
+		}
+		seen[strings.ToLower(o)] = true
+		p.Options = append(p.Options, o)
+	}
+	if closesAt != nil {
+		if !closesAt.After(now) {
+			return database.NewPoll{}, "closesAt must be in the future"
+		}
+		t := closesAt.UTC()
+		p.ClosesAt = &t
+	}
+	return p, ""
+}
+
+// pollTarget reads the poll of the request, replying 404 if it doesn't exist or its message is gone and 403 if the
+// caller is not a member of its conversation
+func (rt *_router) pollTarget(w http.ResponseWriter, params httprouter.Params, ctx reqcontext.RequestContext) (*database.Poll, bool) {
+	pollID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || pollID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	p, err := rt.db.GetPoll(pollID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Printf("GetPoll: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	// 404 se il messaggio è cancellato o scaduto
+	m, err := rt.db.GetMessageByID(p.MessageID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if err != nil || removed(m, globaltime.Now()) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	// 403 se non sei membro
+	ok, err := rt.db.IsUserInConversation(p.ConversationID, ctx.UserID)
+	if err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !ok || !ctx.CanAccessConversation(p.ConversationID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return p, true
+}
+
+// VotePoll sets the votes of the caller in a poll. An empty list of options retracts the vote.
+func (rt *_router) VotePoll(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Options []int `json:"options"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	p, ok := rt.pollTarget(w, params, ctx)
+	if !ok {
+		return
+	}
+
+	// una sola opzione se non è a scelta multipla
+	if !p.MultipleChoice && len(req.Options) > 1 {
+		http.Error(w, "Bad request: this poll allows a single choice", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[int]bool)
+	for _, o := range req.Options {
+		if o < 0 || o >= len(p.Options) || seen[o] {
+			http.Error(w, "Bad request: invalid option", http.StatusBadRequest)
+			return
+		}
+		seen[o] = true
+	}
+
+	open, err := rt.db.SetPollVotes(p.ID, ctx.UserID, req.Options, globaltime.Now().UTC())
+	if err != nil {
+		log.Printf("SetPollVotes: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !open {
+		http.Error(w, "Conflict: the poll is closed", http.StatusConflict)
+		return
+	}
+
+	status := "voted"
+	if len(req.Options) == 0 {
+		status = "retracted"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// ClosePoll closes a poll. Only its creator can close it.
+func (rt *_router) ClosePoll(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	p, ok := rt.pollTarget(w, params, ctx)
+	if !ok {
+		return
+	}
+	if p.CreatorID != ctx.UserID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	closed, err := rt.db.ClosePoll(p.ID, globaltime.Now().UTC())
+	if err != nil {
+		log.Printf("ClosePoll: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !closed {
+		http.Error(w, "Conflict: the poll is already closed", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "closed"})
+}
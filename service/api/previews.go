@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"time"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+	"wasa-project/service/richtext"
+	"wasa-project/service/unfurl"
+)
+
+const (
+	// maxPreviews is the maximum number of links previewed per message
+	maxPreviews = 3
+	// unfurlInterval is how often the worker looks for links to preview, and unfurlBatch how many it fetches at most
+	// each time
+	unfurlInterval = 5 * time.Second
+	unfurlBatch    = 20
+	// unfurlRetry is how long after a failed fetch the link is tried again
+	unfurlRetry = 24 * time.Hour
+)
+
+// previewView is the preview of a link of a message
+type previewView struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"imageUrl,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+// messageLinks returns the URLs of the message to preview: the targets of its links first, then the URLs written in
+// the text. It's empty if link previews are disabled.
+func (rt *_router) messageLinks(text string, entities []database.TextEntity) []string {
+	if rt.unfurler == nil {
+		return nil
+	}
+	var out []string
+	seen := make(map[string]bool)
+	add := func(u string) {
+		if !seen[u] && len(out) < maxPreviews {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	for _, e := range entities {
+		// i link mailto non hanno anteprima
+		if e.Type == richtext.Link && (strings.HasPrefix(e.URL, "http://") || strings.HasPrefix(e.URL, "https://")) {
+			add(e.URL)
+		}
+	}
+	for _, u := range unfurl.ExtractURLs(text) {
+		add(u)
+	}
+	return out
+}
+
+// messagePreviews returns the previews of the links of the message that are ready
+func messagePreviews(d *messageData, messageID int) []previewView {
+	previews := d.previews[messageID]
+	out := make([]previewView, 0, len(previews))
+	for _, p := range previews {
+		out = append(out, previewView{
+			URL:         p.URL,
+			Title:       p.Title,
+			Description: p.Description,
+			ImageURL:    p.ImageURL,
+			SiteName:    p.SiteName,
+		})
+	}
+	return out
+}
+
+// unfurlPending fetches the previews of the links that don't have one yet, and caches them
+func (rt *_router) unfurlPending() {
+	urls, err := rt.db.ListPendingLinks(globaltime.Now().UTC().Add(-unfurlRetry), unfurlBatch)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("listing links to preview")
+		return
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	// la chiusura del router interrompe i download in corso
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-rt.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for _, u := range urls {
+		if ctx.Err() != nil {
+			return
+		}
+		p := database.LinkPreview{URL: u, FetchedAt: globaltime.Now().UTC()}
+		preview, err := rt.unfurler.Fetch(ctx, u)
+		if err != nil {
+			rt.baseLogger.WithError(err).Debugf("no preview for %s", u)
+		} else {
+			p.Title, p.Description, p.ImageURL, p.SiteName = preview.Title, preview.Description, preview.ImageURL, preview.SiteName
+			p.OK = true
+		}
+		if ctx.Err() != nil {
+			// interrotto dalla chiusura: si riprova al prossimo avvio
+			return
+		}
+		if err := rt.db.SaveLinkPreview(p); err != nil {
+			rt.baseLogger.WithError(err).Error("saving link preview")
+			return
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package api
+
+import "wasa-project/service/globaltime"
+
+// purgeDeleted permanently removes the contents of the messages deleted more than the retention period ago
+func (rt *_router) purgeDeleted() {
+	before := globaltime.Now().UTC().Add(-rt.deletedRetention)
+	photos, err := rt.db.PurgeDeletedMessages(before)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("purging deleted messages")
+		return
+	}
+	for _, p := range photos {
+		removeUpload(p)
+	}
+}
+
+// sweepExpired deletes the expired disappearing messages, with their photos
+func (rt *_router) sweepExpired() {
+	photos, err := rt.db.PurgeExpiredMessages(globaltime.Now().UTC())
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("purging expired messages")
+		return
+	}
+	for _, p := range photos {
+		removeUpload(p)
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/ratelimit"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RateLimits contains the limits for each group of rate-limited routes. A zero ratelimit.Limit disables the limit.
+type RateLimits struct {
+	// Login limits the login attempts (username and OIDC) of each IP address
+	Login ratelimit.Limit
+	// Messages limits the messages sent (and forwarded) by each user
+	Messages ratelimit.Limit
+	// Uploads limits the photo uploads of each user
+	Uploads ratelimit.Limit
+}
+
+// limited applies the rate limit of the given route group to the handler. Authenticated callers are limited by user
+// ID, the others (e.g., the login) by IP address. Requests over the limit get a 429 with a Retry-After header.
+// It must be used inside wrap/wrapPublic, as it needs the request context.
+func (rt *_router) limited(route string, limit ratelimit.Limit, fn httpRouterHandler) httpRouterHandler {
+	if limit.Disabled() {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+		key := route + "|ip|" + remoteIP(r)
+		if ctx.UserID != "" {
+			key = route + "|user|" + ctx.UserID
+		}
+
+		res, err := rt.limiter.Allow(key, limit)
+		if err != nil {
+			// meglio lasciar passare che bloccare tutti
+			ctx.Logger.WithError(err).Warning("rate limit store error, letting the request through")
+		} else if !res.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		fn(w, r, ps, ctx)
+	}
+}
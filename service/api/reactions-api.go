@@ -0,0 +1,132 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/emoji"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// reactionView is the aggregated count of an emoji on a message
+type reactionView struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// aggregateReactions groups the reactions by emoji, keeping the order of the first reaction of each
+func aggregateReactions(rs []database.Reaction, uid string) []reactionView {
+	out := make([]reactionView, 0, len(rs))
+	pos := make(map[string]int)
+	for _, r := range rs {
+		i, ok := pos[r.Emoji]
+		if !ok {
+			i = len(out)
+			pos[r.Emoji] = i
+			out = append(out, reactionView{Emoji: r.Emoji})
+		}
+		out[i].Count++
+		if r.UserID == uid {
+			out[i].Reacted = true
+		}
+	}
+	return out
+}
+
+// reactionTarget loads the message of the request, replying 404 if it does not exist (or was deleted, or has expired)
+// and 403 if the caller is not a member of its conversation
+func (rt *_router) reactionTarget(w http.ResponseWriter, params httprouter.Params, uid string) (int, bool) {
+	msgID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || msgID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return 0, false
+	}
+
+	m, err := rt.db.GetMessageByID(msgID)
+	if err == sql.ErrNoRows || (err == nil && removed(m, globaltime.Now())) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return 0, false
+	} else if err != nil {
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	ok, err := rt.db.IsUserInConversation(m.ConversationID, uid)
+	if err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	return msgID, true
+}
+
+// AddReaction adds an emoji to the reactions of the caller to a message
+func (rt *_router) AddReaction(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	var body struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !emoji.IsSingle(body.Emoji) {
+		http.Error(w, "Bad request: a single emoji is required", http.StatusBadRequest)
+		return
+	}
+
+	msgID, ok := rt.reactionTarget(w, params, ctx.UserID)
+	if !ok {
+		return
+	}
+
+	added, err := rt.db.AddReaction(msgID, ctx.UserID, body.Emoji, globaltime.Now().UTC())
+	if err != nil {
+		log.Printf("AddReaction: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// 201 solo se la reazione è nuova
+	if added {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// RemoveReaction removes an emoji from the reactions of the caller to a message
+func (rt *_router) RemoveReaction(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	e := params.ByName("emoji")
+	if !emoji.IsSingle(e) {
+		http.Error(w, "Bad request: a single emoji is required", http.StatusBadRequest)
+		return
+	}
+
+	msgID, ok := rt.reactionTarget(w, params, ctx.UserID)
+	if !ok {
+		return
+	}
+
+	removed, err := rt.db.RemoveReaction(msgID, ctx.UserID, e)
+	if err != nil {
+		log.Printf("RemoveReaction: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		// non avevo reagito con quell'emoji -> 404
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
+}
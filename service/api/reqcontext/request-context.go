@@ -18,4 +18,49 @@ type RequestContext struct {
 
 	// Logger is a custom field logger for the request
 	Logger logrus.FieldLogger
+
+	// UserID is the authenticated caller. It's always set for routes wrapped with wrap, and empty for public routes
+	UserID string
+
+	// SessionID is the server-side session of the caller. It's empty for public routes, legacy tokens and API keys
+	SessionID string
+
+	// APIKey is set when the caller (a bot) authenticated with an API key, and restricts what it can do
+	APIKey *APIKeyGrant
+}
+
+// APIKeyGrant describes what an API key allows
+type APIKeyGrant struct {
+	// ID is the API key identifier
+	ID string
+
+	// Scopes are the operations allowed, e.g. "messages:write"
+	Scopes []string
+
+	// ConversationIDs restricts the key to these conversations. Empty means any conversation the bot is in
+	ConversationIDs []int
+}
+
+// HasScope reports whether the grant includes the scope
+func (g *APIKeyGrant) HasScope(scope string) bool {
+	for _, s := range g.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessConversation reports whether the caller may act on the conversation. Callers authenticated with a session
+// can act on any conversation (membership is checked separately); API keys may be restricted to some conversations.
+func (ctx RequestContext) CanAccessConversation(conversationID int) bool {
+	if ctx.APIKey == nil || len(ctx.APIKey.ConversationIDs) == 0 {
+		return true
+	}
+	for _, id := range ctx.APIKey.ConversationIDs {
+		if id == conversationID {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// dispatchInterval is how often the dispatcher looks for scheduled messages to send, and dispatchBatch how many it
+// sends at most each time. A message that fails dispatchAttempts times is not tried anymore.
+const (
+	dispatchInterval = 10 * time.Second
+	dispatchBatch    = 100
+	dispatchAttempts = 5
+)
+
+// scheduledView is a pending scheduled message, as shown to its sender
+type scheduledView struct {
+	ID               int       `json:"id"`
+	ConversationID   int       `json:"conversationId"`
+	Text             string    `json:"text"`
+	PhotoURL         *string   `json:"photoUrl,omitempty"`
+	ReplyToMessageID *int      `json:"replyToMessageId,omitempty"`
+	ScheduledAt      time.Time `json:"scheduledAt"`
+	CreatedAt        time.Time `json:"createdAt"`
+	// Failed is set when the message could not be sent: it stays here until cancelled
+	Failed bool `json:"failed,omitempty"`
+}
+
+// scheduleMessage stores the message to be sent at the given time, and writes the 202 response
+func (rt *_router) scheduleMessage(w http.ResponseWriter, msg database.NewMessage, at time.Time) {
+	id, err := rt.db.CreateScheduledMessage(database.ScheduledMessage{
+		NewMessage:  msg,
+		ScheduledAt: at.UTC(),
+		CreatedAt:   globaltime.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("CreateScheduledMessage: %v", err)
+		if msg.Photo != nil {
+			removeUpload(*msg.Photo)
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// anche un messaggio programmato svuota la bozza, come uno inviato subito
+	rt.clearDraft(msg.ConversationID, msg.SenderID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(struct {
+		ScheduledID    int       `json:"scheduledId"`
+		ConversationID int       `json:"conversationId"`
+		ScheduledAt    time.Time `json:"scheduledAt"`
+		Status         string    `json:"status"`
+	}{
+		ScheduledID:    id,
+		ConversationID: msg.ConversationID,
+		ScheduledAt:    at.UTC(),
+		Status:         "scheduled",
+	})
+}
+
+// GetMyScheduled returns the messages of the caller that are waiting to be sent
+func (rt *_router) GetMyScheduled(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	list, err := rt.db.ListScheduledMessages(ctx.UserID)
+	if err != nil {
+		log.Printf("ListScheduledMessages: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]scheduledView, 0, len(list))
+	for _, s := range list {
+		out = append(out, scheduledView{
+			ID:               s.ID,
+			ConversationID:   s.ConversationID,
+			Text:             s.Text,
+			PhotoURL:         s.Photo,
+			ReplyToMessageID: s.ReplyToID,
+			ScheduledAt:      s.ScheduledAt,
+			CreatedAt:        s.CreatedAt,
+			Failed:           s.Attempts >= dispatchAttempts,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// CancelScheduled cancels a message of the caller that was not sent yet
+func (rt *_router) CancelScheduled(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// 404 anche se è di un altro utente o è già stato inviato
+	s, err := rt.db.CancelScheduledMessage(id, ctx.UserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("CancelScheduledMessage: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if s.Photo != nil {
+		removeUpload(*s.Photo)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "cancelled"})
+}
+
+// dispatchScheduled sends the scheduled messages whose time has come. A message that can't be sent stays scheduled,
+// with the same ID, and is tried again the next time, up to dispatchAttempts times.
+func (rt *_router) dispatchScheduled() {
+	due, err := rt.db.ListDueScheduledMessages(globaltime.Now().UTC(), dispatchAttempts, dispatchBatch)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("listing due scheduled messages")
+		return
+	}
+
+	for _, s := range due {
+		// chi ha lasciato la conversazione non può più scriverci
+		ok, err := rt.db.IsUserInConversation(s.ConversationID, s.SenderID)
+		if err == nil && !ok {
+			rt.baseLogger.Infof("dropping scheduled message %d: the sender left the conversation", s.ID)
+			if _, err := rt.db.TakeScheduledMessage(s.ID); err == nil && s.Photo != nil {
+				removeUpload(*s.Photo)
+			}
+			continue
+		}
+
+		if err == nil {
+			// il testo è salvato come scritto dall'utente
+			msg := s.NewMessage
+			msg.Text, msg.Entities, err = parseMessageText(s.Text)
+			if err == nil {
+				err = rt.addMentionsAndLinks(&msg)
+			}
+			if err == nil {
+				// tolto dalla coda e inviato insieme: un annullamento concorrente non lo fa partire due volte
+				_, err = rt.db.SendScheduledMessage(s.ID, msg, globaltime.Now().UTC())
+				if errors.Is(err, sql.ErrNoRows) {
+					continue
+				}
+			}
+		}
+		if err != nil {
+			// resta in coda con lo stesso ID; gli altri messaggi partono comunque
+			rt.baseLogger.WithError(err).Errorf("sending scheduled message %d", s.ID)
+			if err := rt.db.RecordScheduledFailure(s.ID); err != nil {
+				rt.baseLogger.WithError(err).Errorf("recording the failure of scheduled message %d", s.ID)
+			}
+		}
+	}
+}
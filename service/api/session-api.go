@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// DoLogout revokes the session used to authenticate the request
+func (rt *_router) DoLogout(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	// i token legacy non hanno una sessione da chiudere
+	if ctx.SessionID == "" {
+		http.Error(w, "Bad request: no session", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := rt.db.RevokeSession(ctx.SessionID, uid, globaltime.Now().UTC()); err != nil {
+		log.Printf("RevokeSession: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "logged out"})
+}
+
+func (rt *_router) ListMySessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	sessions, err := rt.db.ListActiveSessions(uid, globaltime.Now().UTC())
+	if err != nil {
+		log.Printf("ListActiveSessions: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	type sessionView struct {
+		ID         string    `json:"id"`
+		Device     string    `json:"device"`
+		IP         string    `json:"ip"`
+		CreatedAt  time.Time `json:"createdAt"`
+		LastSeenAt time.Time `json:"lastSeenAt"`
+		ExpiresAt  time.Time `json:"expiresAt"`
+		Current    bool      `json:"current"`
+	}
+	out := make([]sessionView, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, sessionView{
+			ID:         s.ID,
+			Device:     s.Device,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+			Current:    s.ID == ctx.SessionID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func (rt *_router) RevokeMySession(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	sid := strings.TrimSpace(params.ByName("id"))
+	if sid == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// 404 anche se la sessione è di un altro utente: non riveliamo che esiste
+	revoked, err := rt.db.RevokeSession(sid, uid, globaltime.Now().UTC())
+	if err != nil {
+		log.Printf("RevokeSession: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
@@ -2,5 +2,7 @@ package api
 
 // Close should close everything opened in the lifecycle of the `_router`; for example, background goroutines.
 func (rt *_router) Close() error {
+	rt.stopOnce.Do(func() { close(rt.stop) })
+	rt.workers.Wait()
 	return nil
 }
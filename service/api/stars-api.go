@@ -0,0 +1,207 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Page size of GET /me/starred
+const (
+	defaultStarredPage = 50
+	maxStarredPage     = 100
+)
+
+// starredView is a message starred by the caller, with the conversation it belongs to
+type starredView struct {
+	ConversationID   int       `json:"conversationId"`
+	ConversationName string    `json:"conversationName"`
+	StarredAt        time.Time `json:"starredAt"`
+	Message          msgView   `json:"message"`
+}
+
+// starTarget loads the message to star, replying 404 if it does not exist (or was deleted, or has expired) and 403 if
+// the caller is not a member of its conversation
+func (rt *_router) starTarget(w http.ResponseWriter, params httprouter.Params, uid string) (int, bool) {
+	msgID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || msgID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return 0, false
+	}
+
+	m, err := rt.db.GetMessageByID(msgID)
+	if err == sql.ErrNoRows || (err == nil && removed(m, globaltime.Now())) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return 0, false
+	} else if err != nil {
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	ok, err := rt.db.IsUserInConversation(m.ConversationID, uid)
+	if err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	return msgID, true
+}
+
+// StarMessage adds a message to the starred messages of the caller
+func (rt *_router) StarMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	msgID, ok := rt.starTarget(w, params, ctx.UserID)
+	if !ok {
+		return
+	}
+
+	if _, err := rt.db.StarMessage(msgID, ctx.UserID, globaltime.Now().UTC()); err != nil {
+		log.Printf("StarMessage: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "starred"})
+}
+
+// UnstarMessage removes a message from the starred messages of the caller
+func (rt *_router) UnstarMessage(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	msgID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || msgID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// si può togliere la stella anche se nel frattempo si è lasciato il gruppo
+	removed, err := rt.db.UnstarMessage(msgID, ctx.UserID)
+	if err != nil {
+		log.Printf("UnstarMessage: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "unstarred"})
+}
+
+// GetMyStarred returns a page of the messages starred by the caller, latest star first, in the conversations they
+// are still a member of. The next page starts before the star in nextBefore, which is missing on the last page.
+func (rt *_router) GetMyStarred(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	q := r.URL.Query()
+	limit := defaultStarredPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxStarredPage)
+	}
+	before := 0
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+
+	// le conversazioni lasciate si saltano, quindi si legge a blocchi finché la pagina (più una riga) non è piena
+	member := make(map[int]bool)
+	data := make(map[int]*messageData)
+	out := make([]starredView, 0, limit)
+	var ids []int
+	now := globaltime.Now().UTC()
+	for len(out) <= limit {
+		stars, err := rt.db.ListStars(uid, before, limit+1, now)
+		if err != nil {
+			log.Printf("ListStars: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		for _, s := range stars {
+			before = s.ID
+			ok, seen := member[s.ConversationID]
+			if !seen {
+				// le chiavi API vedono solo le conversazioni a cui sono limitate
+				ok = ctx.CanAccessConversation(s.ConversationID)
+				if ok {
+					ok, err = rt.db.IsUserInConversation(s.ConversationID, uid)
+				}
+				if err != nil {
+					log.Printf("IsUserInConversation: %v", err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				member[s.ConversationID] = ok
+				if ok {
+					if data[s.ConversationID], err = rt.loadMessageData(s.ConversationID, now); err != nil {
+						log.Printf("loadMessageData: %v", err)
+						http.Error(w, "internal error", http.StatusInternalServerError)
+						return
+					}
+				}
+			}
+			if !ok {
+				continue
+			}
+
+			m, err := rt.db.GetMessageByID(s.MessageID)
+			if err != nil {
+				log.Printf("GetMessageByID: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			v := rt.messageView(*m, uid, data[s.ConversationID])
+			v.Starred = true
+			out = append(out, starredView{
+				ConversationID:   s.ConversationID,
+				ConversationName: s.ConversationName,
+				StarredAt:        s.StarredAt,
+				Message:          v,
+			})
+			ids = append(ids, s.ID)
+			if len(out) > limit {
+				break
+			}
+		}
+		if len(stars) <= limit {
+			break
+		}
+	}
+
+	var nextBefore *int
+	if len(out) > limit {
+		out = out[:limit]
+		nextBefore = &ids[limit-1]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Starred    []starredView `json:"starred"`
+		NextBefore *int          `json:"nextBefore,omitempty"`
+	}{
+		Starred:    out,
+		NextBefore: nextBefore,
+	})
+}
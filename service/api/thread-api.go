@@ -0,0 +1,186 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Page size of GET /messages/:id/thread
+const (
+	defaultThreadPage = 50
+	maxThreadPage     = 100
+)
+
+// threadRoot loads the root of the thread of the message in the request: replies to a thread reply go to the same
+// thread. It replies 404 if the message does not exist and 403 if the caller can't access its conversation.
+func (rt *_router) threadRoot(w http.ResponseWriter, params httprouter.Params, ctx reqcontext.RequestContext) (*database.Message, bool) {
+	msgID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || msgID <= 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// 404 se il messaggio non esiste
+	m, err := rt.db.GetMessageByID(msgID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("GetMessageByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// 403 se il caller non è membro della conversazione
+	ok, err := rt.db.IsUserInConversation(m.ConversationID, ctx.UserID)
+	if err != nil {
+		log.Printf("IsUserInConversation: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !ok || !ctx.CanAccessConversation(m.ConversationID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	if m.ThreadRootID != nil {
+		if m, err = rt.db.GetMessageByID(*m.ThreadRootID); err != nil {
+			log.Printf("GetMessageByID: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+// PostThreadReply posts a reply in the thread of a message
+func (rt *_router) PostThreadReply(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	root, ok := rt.threadRoot(w, params, ctx)
+	if !ok {
+		return
+	}
+	// niente nuove risposte a un messaggio cancellato o scaduto
+	if removed(root, globaltime.Now()) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	req, ok := decodeMessageRequest(w, r)
+	if !ok {
+		return
+	}
+	// le risposte programmate non sono supportate nei thread
+	if req.ScheduledAt != nil {
+		http.Error(w, "Bad request: scheduledAt is not supported for thread replies", http.StatusBadRequest)
+		return
+	}
+	if !rt.checkReplyTo(w, req, root.ConversationID) {
+		return
+	}
+	photo, err := storeMessagePhoto(req)
+	if err != nil {
+		log.Printf("storeMessagePhoto: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	msg := req.message(root.ConversationID, ctx.UserID, photo)
+	msg.ThreadRootID = &root.ID
+	msgID, err := rt.insertMessage(msg)
+	if err != nil {
+		log.Printf("InsertMessage: %v", err)
+		if photo != nil {
+			removeUpload(*photo)
+		}
+		http.Error(w, "failed to send message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(struct {
+		MessageID    int    `json:"messageId"`
+		ThreadRootID int    `json:"threadRootId"`
+		Status       string `json:"status"`
+	}{
+		MessageID:    msgID,
+		ThreadRootID: root.ID,
+		Status:       "sent",
+	})
+}
+
+// GetThread returns the root message of a thread and a page of its replies, oldest first. The next page starts after
+// the reply in nextAfter, which is missing on the last page.
+func (rt *_router) GetThread(w http.ResponseWriter, r *http.Request, params httprouter.Params, ctx reqcontext.RequestContext) {
+	q := r.URL.Query()
+	limit := defaultThreadPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxThreadPage)
+	}
+	after := 0
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+
+	root, ok := rt.threadRoot(w, params, ctx)
+	if !ok {
+		return
+	}
+
+	// una riga in più per sapere se c'è un'altra pagina
+	now := globaltime.Now().UTC()
+	replies, err := rt.db.ListThreadReplies(root.ID, ctx.UserID, after, limit+1, now)
+	if err != nil {
+		log.Printf("ListThreadReplies: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var nextAfter *int
+	if len(replies) > limit {
+		replies = replies[:limit]
+		nextAfter = &replies[limit-1].ID
+	}
+
+	data, err := rt.loadMessageData(root.ConversationID, now)
+	if err != nil {
+		log.Printf("loadMessageData: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	rootView := rt.messageView(*root, ctx.UserID, data)
+	out := make([]msgView, 0, len(replies))
+	for _, m := range replies {
+		out = append(out, rt.messageView(m, ctx.UserID, data))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Root      msgView   `json:"root"`
+		Replies   []msgView `json:"replies"`
+		NextAfter *int      `json:"nextAfter,omitempty"`
+	}{
+		Root:      rootView,
+		Replies:   out,
+		NextAfter: nextAfter,
+	})
+}
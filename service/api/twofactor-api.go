@@ -0,0 +1,311 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+	"wasa-project/service/api/reqcontext"
+	"wasa-project/service/auth"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// challengeTTL is the lifetime of the challenge token returned after the password, when a code is required
+	challengeTTL = 5 * time.Minute
+	// recoveryCodeCount is the number of recovery codes generated when the second factor is enabled
+	recoveryCodeCount = 10
+)
+
+// SetupTOTP starts the setup of the second factor: it returns a new secret, that becomes active only after
+// ConfirmTOTP. Only accounts with a password can enable it.
+func (rt *_router) SetupTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	creds, err := rt.db.GetUserCredentials(uid)
+	if err != nil {
+		log.Printf("GetUserCredentials: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if creds.PasswordHash == nil {
+		http.Error(w, "Forbidden: set a password first", http.StatusForbidden)
+		return
+	}
+
+	t, err := rt.db.GetTOTP(uid)
+	if err != nil {
+		log.Printf("GetTOTP: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// 409 se è già attivo: prima va disattivato
+	if t.Enabled {
+		http.Error(w, "Conflict: two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+
+	u, err := rt.db.GetUserByID(uid)
+	if err != nil {
+		log.Printf("GetUserByID: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		log.Printf("NewTOTPSecret: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := rt.db.SetPendingTOTP(uid, secret); err != nil {
+		log.Printf("SetPendingTOTP: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"secret":     secret,
+		"otpauthUri": auth.TOTPURI(rt.tokens.Issuer(), u.Username, secret),
+	})
+}
+
+// ConfirmTOTP enables the second factor, if the code matches the pending secret, and returns the recovery codes.
+// Wrong codes count towards the account lockout.
+func (rt *_router) ConfirmTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	creds, err := rt.db.GetUserCredentials(uid)
+	if err != nil {
+		log.Printf("GetUserCredentials: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// i codici sbagliati contano come login falliti, come nel secondo passo del login
+	now := globaltime.Now().UTC()
+	if isLocked(w, creds, now) {
+		return
+	}
+
+	t, err := rt.db.GetTOTP(uid)
+	if err != nil {
+		log.Printf("GetTOTP: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if t.Enabled {
+		http.Error(w, "Conflict: two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+	if t.Secret == nil {
+		http.Error(w, "Bad request: no pending setup", http.StatusBadRequest)
+		return
+	}
+
+	counter, ok := auth.CheckTOTP(*t.Secret, req.Code, t.LastCounter)
+	if !ok {
+		if err := rt.db.RecordLoginFailure(uid, rt.maxLoginFailures, now.Add(rt.loginLockout)); err != nil {
+			log.Printf("RecordLoginFailure: %v", err)
+		}
+		http.Error(w, "Bad request: invalid code", http.StatusBadRequest)
+		return
+	}
+	if creds.FailedLogins > 0 || creds.LockedUntil != nil {
+		if err := rt.db.ResetLoginFailures(uid); err != nil {
+			log.Printf("ResetLoginFailures: %v", err)
+		}
+	}
+
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		log.Printf("NewRecoveryCodes: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, c := range codes {
+		hashes = append(hashes, auth.HashRecoveryCode(c))
+	}
+	if err := rt.db.EnableTOTP(uid, counter, hashes); err != nil {
+		log.Printf("EnableTOTP: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Status        string   `json:"status"`
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{
+		Status:        "enabled",
+		RecoveryCodes: codes,
+	})
+}
+
+// DisableTOTP turns off the second factor. A valid code (or recovery code) is required, and wrong codes count towards
+// the account lockout.
+func (rt *_router) DisableTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	uid := ctx.UserID
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	creds, err := rt.db.GetUserCredentials(uid)
+	if err != nil {
+		log.Printf("GetUserCredentials: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// i codici sbagliati contano come login falliti, come nel secondo passo del login
+	now := globaltime.Now().UTC()
+	if isLocked(w, creds, now) {
+		return
+	}
+
+	t, err := rt.db.GetTOTP(uid)
+	if err != nil {
+		log.Printf("GetTOTP: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !t.Enabled {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	ok, err := rt.checkSecondFactor(uid, t, req.Code)
+	if err != nil {
+		log.Printf("checkSecondFactor: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if err := rt.db.RecordLoginFailure(uid, rt.maxLoginFailures, now.Add(rt.loginLockout)); err != nil {
+			log.Printf("RecordLoginFailure: %v", err)
+		}
+		http.Error(w, "Bad request: invalid code", http.StatusBadRequest)
+		return
+	}
+	if creds.FailedLogins > 0 || creds.LockedUntil != nil {
+		if err := rt.db.ResetLoginFailures(uid); err != nil {
+			log.Printf("ResetLoginFailures: %v", err)
+		}
+	}
+
+	if err := rt.db.DisableTOTP(uid); err != nil {
+		log.Printf("DisableTOTP: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "disabled"})
+}
+
+// writeChallenge writes the response of the first login step, when the account requires a second factor
+func (rt *_router) writeChallenge(w http.ResponseWriter, userID string) {
+	token, claims, err := rt.tokens.IssueChallenge(userID, auth.PurposeSecondFactor, challengeTTL)
+	if err != nil {
+		log.Printf("IssueChallenge: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(struct {
+		ChallengeToken string    `json:"challengeToken"`
+		SecondFactor   string    `json:"secondFactor"`
+		ExpiresAt      time.Time `json:"expiresAt"`
+	}{
+		ChallengeToken: token,
+		SecondFactor:   "totp",
+		ExpiresAt:      claims.Expiry(),
+	})
+}
+
+// completeSecondFactor is the second login step: it checks the challenge token and the code, then opens the session.
+// Wrong codes count as failed logins, so the lockout also applies to them.
+func (rt *_router) completeSecondFactor(w http.ResponseWriter, r *http.Request, challenge, code, device string) {
+	claims, err := rt.tokens.VerifyChallenge(challenge, auth.PurposeSecondFactor)
+	if err != nil {
+		http.Error(w, "Not authorized: invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	uid := claims.Subject
+
+	creds, err := rt.db.GetUserCredentials(uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not authorized: invalid or expired challenge", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("GetUserCredentials: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	now := globaltime.Now().UTC()
+	if isLocked(w, creds, now) {
+		return
+	}
+
+	t, err := rt.db.GetTOTP(uid)
+	if err != nil {
+		log.Printf("GetTOTP: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ok := false
+	if t.Enabled {
+		ok, err = rt.checkSecondFactor(uid, t, code)
+		if err != nil {
+			log.Printf("checkSecondFactor: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !ok {
+		if err := rt.db.RecordLoginFailure(uid, rt.maxLoginFailures, now.Add(rt.loginLockout)); err != nil {
+			log.Printf("RecordLoginFailure: %v", err)
+		}
+		http.Error(w, "Not authorized: invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if creds.FailedLogins > 0 || creds.LockedUntil != nil {
+		if err := rt.db.ResetLoginFailures(uid); err != nil {
+			log.Printf("ResetLoginFailures: %v", err)
+		}
+	}
+	rt.writeSession(w, r, uid, device)
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code, and consumes it
+func (rt *_router) checkSecondFactor(userID string, t *database.TOTP, code string) (bool, error) {
+	if t.Secret == nil || code == "" {
+		return false, nil
+	}
+	if counter, ok := auth.CheckTOTP(*t.Secret, code, t.LastCounter); ok {
+		// può fallire se lo stesso codice è appena stato usato da un'altra richiesta
+		return rt.db.UseTOTPCounter(userID, counter)
+	}
+	return rt.db.UseRecoveryCode(userID, auth.HashRecoveryCode(code), globaltime.Now().UTC())
+}
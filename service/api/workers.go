@@ -0,0 +1,39 @@
+package api
+
+import "time"
+
+// purgeInterval is how often the tombstones past the retention period are purged, and sweepInterval how often the
+// expired messages are deleted
+const (
+	purgeInterval = time.Hour
+	sweepInterval = time.Minute
+)
+
+// StartWorkers starts the background jobs of the router. They are stopped by Close.
+func (rt *_router) StartWorkers() {
+	rt.every("purge", purgeInterval, rt.purgeDeleted)
+	rt.every("scheduled", dispatchInterval, rt.dispatchScheduled)
+	rt.every("expiry", sweepInterval, rt.sweepExpired)
+	if rt.unfurler != nil {
+		rt.every("unfurl", unfurlInterval, rt.unfurlPending)
+	}
+}
+
+// every runs job now and then every interval, until the router is closed
+func (rt *_router) every(name string, interval time.Duration, job func()) {
+	rt.workers.Add(1)
+	go func() {
+		defer rt.workers.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			job()
+			select {
+			case <-rt.stop:
+				rt.baseLogger.Debugf("worker %s stopped", name)
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
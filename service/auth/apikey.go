@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// APIKeyPrefix starts every API key, so that keys are easy to tell apart from session tokens (and to spot in leaks)
+const APIKeyPrefix = "wasa_"
+
+// API key scopes
+const (
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+)
+
+// ValidScope reports whether the scope is known
+func ValidScope(scope string) bool {
+	return scope == ScopeMessagesRead || scope == ScopeMessagesWrite
+}
+
+// IsAPIKey reports whether the string looks like an API key
+func IsAPIKey(raw string) bool {
+	return strings.HasPrefix(raw, APIKeyPrefix)
+}
+
+// NewAPIKey generates a new API key. The key is made of a public ID and a secret: only the ID and the hash of the
+// secret (see HashAPIKeySecret) should be stored, the key is shown once to the user.
+func NewAPIKey() (id, secret, key string, err error) {
+	rawID := make([]byte, 8)
+	rawSecret := make([]byte, 32)
+	if _, err = rand.Read(rawID); err != nil {
+		return "", "", "", err
+	}
+	if _, err = rand.Read(rawSecret); err != nil {
+		return "", "", "", err
+	}
+	id = hex.EncodeToString(rawID)
+	secret = hex.EncodeToString(rawSecret)
+	return id, secret, APIKeyPrefix + id + "_" + secret, nil
+}
+
+// ParseAPIKey splits the API key in its ID and secret
+func ParseAPIKey(key string) (id, secret string, ok bool) {
+	if !IsAPIKey(key) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, APIKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// HashAPIKeySecret returns the hash of the secret to be stored. The secret is random and long, so a fast hash is enough.
+func HashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckAPIKeySecret reports whether the secret matches the stored hash, in constant time
+func CheckAPIKeySecret(hash, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(HashAPIKeySecret(secret))) == 1
+}
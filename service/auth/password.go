@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// MinPasswordLen is the minimum length of a password, in bytes
+	MinPasswordLen = 8
+	// MaxPasswordLen is the maximum length of a password, in bytes (bcrypt ignores anything longer)
+	MaxPasswordLen = 72
+)
+
+// ErrPasswordLength is returned when the password is too short or too long
+var ErrPasswordLength = errors.New("password must be between 8 and 72 bytes long")
+
+// HashPassword returns the bcrypt hash of the password
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLen || len(password) > MaxPasswordLen {
+		return "", ErrPasswordLength
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether the password matches the hash. The comparison is done in constant time.
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
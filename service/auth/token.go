@@ -0,0 +1,179 @@
+/*
+Package auth contains the primitives used by the API to authenticate callers. Tokens issued here are compact JWTs signed
+with HMAC-SHA256 (HS256): the signing key is provided by the configuration and never leaves the server.
+*/
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"wasa-project/service/globaltime"
+)
+
+var (
+	// ErrMalformedToken is returned when the token is not a well-formed signed token
+	ErrMalformedToken = errors.New("malformed token")
+	// ErrInvalidSignature is returned when the token signature does not match the signing key
+	ErrInvalidSignature = errors.New("invalid token signature")
+	// ErrExpiredToken is returned when the token is past its expiry time
+	ErrExpiredToken = errors.New("token expired")
+	// ErrInvalidIssuer is returned when the token was issued by someone else
+	ErrInvalidIssuer = errors.New("invalid token issuer")
+	// ErrWrongPurpose is returned when the token was issued for something else (e.g., a challenge used as session)
+	ErrWrongPurpose = errors.New("token not valid for this purpose")
+)
+
+// PurposeSecondFactor marks the challenge tokens issued after the password, when the second factor is still missing
+const PurposeSecondFactor = "2fa"
+
+// Claims is the payload carried by a signed token
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	SessionID string `json:"sid,omitempty"`
+	Purpose   string `json:"pur,omitempty"`
+}
+
+// Expiry returns the expiration time of the token
+func (c Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0).UTC()
+}
+
+// Signer issues and verifies signed tokens
+type Signer struct {
+	key    []byte
+	issuer string
+	ttl    time.Duration
+}
+
+// tokenHeader is the only JOSE header we emit and accept
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// NewSigner returns a new Signer. The key must be at least 32 bytes long, and the ttl must be positive.
+func NewSigner(key []byte, issuer string, ttl time.Duration) (*Signer, error) {
+	if len(key) < 32 {
+		return nil, errors.New("token key must be at least 32 bytes long")
+	}
+	if issuer == "" {
+		return nil, errors.New("token issuer is required")
+	}
+	if ttl <= 0 {
+		return nil, errors.New("token TTL must be positive")
+	}
+	return &Signer{key: key, issuer: issuer, ttl: ttl}, nil
+}
+
+// Issuer returns the issuer stamped on the tokens
+func (s *Signer) Issuer() string {
+	return s.issuer
+}
+
+// Issue returns a new token for the given subject and server-side session, together with its claims
+func (s *Signer) Issue(subject, sessionID string) (string, Claims, error) {
+	now := globaltime.Now()
+	return s.issue(Claims{
+		Issuer:    s.issuer,
+		Subject:   subject,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.ttl).Unix(),
+		SessionID: sessionID,
+	})
+}
+
+// IssueChallenge returns a short-lived token for the given subject and purpose. It can't be used as session token.
+func (s *Signer) IssueChallenge(subject, purpose string, ttl time.Duration) (string, Claims, error) {
+	now := globaltime.Now()
+	return s.issue(Claims{
+		Issuer:    s.issuer,
+		Subject:   subject,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Purpose:   purpose,
+	})
+}
+
+func (s *Signer) issue(claims Claims) (string, Claims, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(s.sign(unsigned)), claims, nil
+}
+
+// Verify checks the token signature, issuer and expiry, and returns its claims. Challenge tokens are rejected.
+func (s *Signer) Verify(token string) (*Claims, error) {
+	claims, err := s.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, ErrWrongPurpose
+	}
+	return claims, nil
+}
+
+// VerifyChallenge is like Verify, but it accepts only challenge tokens issued for the given purpose
+func (s *Signer) VerifyChallenge(token, purpose string) (*Claims, error) {
+	claims, err := s.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, ErrWrongPurpose
+	}
+	return claims, nil
+}
+
+func (s *Signer) verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	// Only our own header is accepted: this rules out "alg: none" and algorithm confusion
+	if parts[0] != tokenHeader {
+		return nil, ErrMalformedToken
+	}
+
+	got, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if !hmac.Equal(got, s.sign(parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return nil, ErrMalformedToken
+	}
+	if claims.Issuer != s.issuer {
+		return nil, ErrInvalidIssuer
+	}
+	if globaltime.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// IsSignedToken reports whether the string looks like a token issued by a Signer (as opposed to a legacy raw user ID)
+func IsSignedToken(raw string) bool {
+	return strings.Count(raw, ".") == 2
+}
+
+func (s *Signer) sign(unsigned string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestSigner(t *testing.T, issuer string) *Signer {
+	t.Helper()
+	s, err := NewSigner(testKey, issuer, time.Hour)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	return s
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	setTime(t, 1700000000)
+	s := newTestSigner(t, "wasa")
+	token, _, err := s.Issue("u1", "s1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	c, err := s.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if c.Subject != "u1" || c.SessionID != "s1" || c.Issuer != "wasa" || c.ExpiresAt != 1700000000+3600 {
+		t.Errorf("Verify = %+v", *c)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	setTime(t, 1700000000)
+	s := newTestSigner(t, "wasa")
+	token, _, err := s.Issue("u1", "s1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	parts := strings.Split(token, ".")
+
+	// un bit diverso nella firma
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sig[0] ^= 1
+	badSig := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+	if _, err := s.Verify(badSig); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify with a tampered signature: err = %v, want ErrInvalidSignature", err)
+	}
+
+	// un altro utente con la firma originale
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"wasa","sub":"admin","iat":1700000000,"exp":1700003600,"sid":"s1"}`))
+	if _, err := s.Verify(parts[0] + "." + payload + "." + parts[2]); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify with a tampered payload: err = %v, want ErrInvalidSignature", err)
+	}
+
+	// un token firmato con un'altra chiave
+	other, err := NewSigner([]byte("another key, at least 32 bytes long"), "wasa", time.Hour)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	if _, err := other.Verify(token); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify with another key: err = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestVerifyAlgNone(t *testing.T) {
+	setTime(t, 1700000000)
+	s := newTestSigner(t, "wasa")
+	token, _, err := s.Issue("u1", "s1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	parts := strings.Split(token, ".")
+
+	for _, header := range []string{`{"alg":"none","typ":"JWT"}`, `{"alg":"none"}`, `{"alg":"HS512","typ":"JWT"}`} {
+		h := base64.RawURLEncoding.EncodeToString([]byte(header))
+		// senza firma e con la firma originale
+		for _, forged := range []string{h + "." + parts[1] + ".", h + "." + parts[1] + "." + parts[2]} {
+			if _, err := s.Verify(forged); !errors.Is(err, ErrMalformedToken) {
+				t.Errorf("Verify with header %s: err = %v, want ErrMalformedToken", header, err)
+			}
+		}
+	}
+}
+
+func TestVerifyWrongIssuer(t *testing.T) {
+	setTime(t, 1700000000)
+	token, _, err := newTestSigner(t, "someone-else").Issue("u1", "s1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if _, err := newTestSigner(t, "wasa").Verify(token); !errors.Is(err, ErrInvalidIssuer) {
+		t.Errorf("Verify: err = %v, want ErrInvalidIssuer", err)
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	setTime(t, 1700000000)
+	s := newTestSigner(t, "wasa")
+	token, claims, err := s.Issue("u1", "s1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	setTime(t, claims.ExpiresAt-1)
+	if _, err := s.Verify(token); err != nil {
+		t.Errorf("Verify one second before exp: %v", err)
+	}
+	// a exp il token è già scaduto
+	setTime(t, claims.ExpiresAt)
+	if _, err := s.Verify(token); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("Verify at exp: err = %v, want ErrExpiredToken", err)
+	}
+}
+
+func TestVerifyPurpose(t *testing.T) {
+	setTime(t, 1700000000)
+	s := newTestSigner(t, "wasa")
+	session, _, err := s.Issue("u1", "s1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	challenge, _, err := s.IssueChallenge("u1", PurposeSecondFactor, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("IssueChallenge: %v", err)
+	}
+
+	if _, err := s.Verify(challenge); !errors.Is(err, ErrWrongPurpose) {
+		t.Errorf("Verify of a challenge: err = %v, want ErrWrongPurpose", err)
+	}
+	if _, err := s.VerifyChallenge(session, PurposeSecondFactor); !errors.Is(err, ErrWrongPurpose) {
+		t.Errorf("VerifyChallenge of a session token: err = %v, want ErrWrongPurpose", err)
+	}
+	if _, err := s.VerifyChallenge(challenge, "other"); !errors.Is(err, ErrWrongPurpose) {
+		t.Errorf("VerifyChallenge with another purpose: err = %v, want ErrWrongPurpose", err)
+	}
+	if c, err := s.VerifyChallenge(challenge, PurposeSecondFactor); err != nil || c.Subject != "u1" {
+		t.Errorf("VerifyChallenge = %v, %v", c, err)
+	}
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // RFC 6238 uses HMAC-SHA1, and authenticator apps expect it
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"wasa-project/service/globaltime"
+)
+
+const (
+	// TOTPDigits is the number of digits of a one-time password
+	TOTPDigits = 6
+	// TOTPPeriod is the validity of a one-time password, in seconds
+	TOTPPeriod = 30
+	// totpSkew is the number of periods accepted before and after the current one, to tolerate clock drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a new random TOTP secret, base32-encoded as authenticator apps expect it
+func NewTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(raw), nil
+}
+
+// TOTPURI returns the otpauth:// URI to be shown as QR code to the user
+func TOTPURI(issuer, account, secret string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTPDigits)},
+		"period":    {fmt.Sprint(TOTPPeriod)},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// CheckTOTP verifies the code against the secret at the current time (see globaltime.Now). Codes of a time step not
+// after lastCounter are rejected, so a code can't be used twice: on success, the caller must store the returned
+// counter as the new lastCounter.
+func CheckTOTP(secret, code string, lastCounter int64) (counter int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil || len(code) != TOTPDigits {
+		return 0, false
+	}
+	now := globaltime.Now().Unix() / TOTPPeriod
+	for c := now - totpSkew; c <= now+totpSkew; c++ {
+		if c <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the HOTP value (RFC 4226) for the counter
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, value%1000000)
+}
+
+// NewRecoveryCodes returns n random one-time recovery codes, in the form "xxxxx-xxxxx"
+func NewRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(raw)
+		codes = append(codes, h[:5]+"-"+h[5:])
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode returns the hash of the recovery code to be stored. Case and dashes are ignored.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wasa-project/service/database"
+	"wasa-project/service/globaltime"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// rfcSecret is the SHA-1 seed of the test vectors of RFC 6238 ("12345678901234567890"), base32-encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// setTime fixes the clock used by CheckTOTP for the rest of the test
+func setTime(t *testing.T, unix int64) {
+	t.Helper()
+	globaltime.FixedTime = time.Unix(unix, 0).UTC()
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+}
+
+func TestCheckTOTPVectors(t *testing.T) {
+	// RFC 6238, appendice B: i codici a 6 cifre sono le ultime 6 degli 8 della tabella
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		setTime(t, tt.unix)
+		counter, ok := CheckTOTP(rfcSecret, tt.code, 0)
+		if !ok {
+			t.Errorf("CheckTOTP(%s) at %d: refused", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / TOTPPeriod; counter != want {
+			t.Errorf("CheckTOTP(%s) at %d: counter = %d, want %d", tt.code, tt.unix, counter, want)
+		}
+	}
+}
+
+func TestCheckTOTPWindow(t *testing.T) {
+	// 1111111111 è nel passo 37037037: il codice vale dal passo prima al passo dopo
+	const code = "050471"
+	tests := []struct {
+		unix int64
+		ok   bool
+	}{
+		{1111111111 - 2*TOTPPeriod, false},
+		{1111111111 - TOTPPeriod, true},
+		{1111111111, true},
+		{1111111111 + TOTPPeriod, true},
+		{1111111111 + 2*TOTPPeriod, false},
+	}
+	for _, tt := range tests {
+		setTime(t, tt.unix)
+		if _, ok := CheckTOTP(rfcSecret, code, 0); ok != tt.ok {
+			t.Errorf("CheckTOTP at %d: ok = %v, want %v", tt.unix, ok, tt.ok)
+		}
+	}
+}
+
+func TestCheckTOTPRejectsUsedStep(t *testing.T) {
+	setTime(t, 1111111111)
+	counter, ok := CheckTOTP(rfcSecret, "050471", 0)
+	if !ok {
+		t.Fatal("CheckTOTP: first use refused")
+	}
+	if _, ok := CheckTOTP(rfcSecret, "050471", counter); ok {
+		t.Error("CheckTOTP: the same time step was accepted twice")
+	}
+	// anche un codice precedente a quello già usato
+	if _, ok := CheckTOTP(rfcSecret, "081804", counter); ok {
+		t.Error("CheckTOTP: an earlier time step was accepted after a later one")
+	}
+}
+
+func TestCheckTOTPInvalid(t *testing.T) {
+	setTime(t, 59)
+	for _, tt := range []struct{ secret, code string }{
+		{rfcSecret, "287083"},
+		{rfcSecret, "28708"},
+		{rfcSecret, ""},
+		{"not base32!", "287082"},
+	} {
+		if _, ok := CheckTOTP(tt.secret, tt.code, 0); ok {
+			t.Errorf("CheckTOTP(%q, %q) accepted", tt.secret, tt.code)
+		}
+	}
+}
+
+func TestRecoveryCodesSingleUse(t *testing.T) {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=1")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer conn.Close()
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatalf("database.New: %v", err)
+	}
+	if err := db.CreateUser("u1", "alice"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	codes, err := NewRecoveryCodes(2)
+	if err != nil {
+		t.Fatalf("NewRecoveryCodes: %v", err)
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, c := range codes {
+		hashes = append(hashes, HashRecoveryCode(c))
+	}
+	if err := db.SetPendingTOTP("u1", rfcSecret); err != nil {
+		t.Fatalf("SetPendingTOTP: %v", err)
+	}
+	if err := db.EnableTOTP("u1", 0, hashes); err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+
+	now := time.Unix(1111111111, 0).UTC()
+	// maiuscole, spazi e trattini non contano
+	typed := " " + strings.ToUpper(codes[0][:3]+"-"+codes[0][3:]) + " "
+	if ok, err := db.UseRecoveryCode("u1", HashRecoveryCode(typed), now); err != nil || !ok {
+		t.Fatalf("UseRecoveryCode: first use = %v, %v", ok, err)
+	}
+	if ok, err := db.UseRecoveryCode("u1", HashRecoveryCode(codes[0]), now); err != nil || ok {
+		t.Errorf("UseRecoveryCode: second use = %v, %v, want false", ok, err)
+	}
+	if ok, err := db.UseRecoveryCode("u1", HashRecoveryCode(codes[1]), now); err != nil || !ok {
+		t.Errorf("UseRecoveryCode: other code = %v, %v", ok, err)
+	}
+	if ok, err := db.UseRecoveryCode("u1", HashRecoveryCode("00000-00000"), now); err != nil || ok {
+		t.Errorf("UseRecoveryCode: unknown code = %v, %v, want false", ok, err)
+	}
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// APIKey is a long-lived credential of a bot. Only the hash of the secret is stored. An empty ConversationIDs list
+// means that the key is not restricted to specific conversations.
+type APIKey struct {
+	ID              string
+	UserID          string
+	SecretHash      string
+	Scopes          []string
+	ConversationIDs []int
+	CreatedAt       time.Time
+	LastUsedAt      *time.Time
+	RevokedAt       *time.Time
+}
+
+func (db *appdbimpl) CreateBot(id, name, ownerID string) error {
+	_, err := db.c.Exec(`INSERT INTO users (id, username, kind, owner_id) VALUES (?, ?, ?, ?)`,
+		id, name, UserKindBot, ownerID)
+	return err
+}
+
+func (db *appdbimpl) ListBots(ownerID string) ([]User, error) {
+	rows, err := db.c.Query(`
+		SELECT id, username, photo, kind
+		FROM users
+		WHERE kind = ? AND owner_id = ?
+		ORDER BY username`, UserKindBot, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.PhotoURL, &u.Kind); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+func (db *appdbimpl) CreateAPIKey(k APIKey) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(`
+		INSERT INTO api_keys (id, user_id, secret_hash, scopes, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		k.ID, k.UserID, k.SecretHash, strings.Join(k.Scopes, " "), k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for _, convID := range k.ConversationIDs {
+		if _, err := tx.Exec(`INSERT INTO api_key_conversations (key_id, conversation_id) VALUES (?, ?)`,
+			k.ID, convID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *appdbimpl) GetAPIKey(id string) (*APIKey, error) {
+	row := db.c.QueryRow(`
+		SELECT id, user_id, secret_hash, scopes, created_at, last_used_at, revoked_at
+		FROM api_keys
+		WHERE id = ?`, id)
+	var k APIKey
+	var scopes string
+	if err := row.Scan(&k.ID, &k.UserID, &k.SecretHash, &scopes, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+		return nil, err // può essere sql.ErrNoRows
+	}
+	k.Scopes = strings.Fields(scopes)
+
+	rows, err := db.c.Query(`SELECT conversation_id FROM api_key_conversations WHERE key_id = ? ORDER BY conversation_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var convID int
+		if err := rows.Scan(&convID); err != nil {
+			return nil, err
+		}
+		k.ConversationIDs = append(k.ConversationIDs, convID)
+	}
+	return &k, rows.Err()
+}
+
+func (db *appdbimpl) TouchAPIKey(id string, lastUsed time.Time) error {
+	_, err := db.c.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, lastUsed, id)
+	return err
+}
+
+// RevokeAPIKey revokes a key of the bot. It returns false if there is no such (active) key.
+func (db *appdbimpl) RevokeAPIKey(id, botID string, at time.Time) (bool, error) {
+	res, err := db.c.Exec(`
+		UPDATE api_keys SET revoked_at = ?
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		at, id, botID)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
@@ -0,0 +1,48 @@
+package database
+
+import "time"
+
+// Credentials are the login data of a user. PasswordHash is nil for unclaimed accounts.
+type Credentials struct {
+	UserID       string
+	PasswordHash *string
+	FailedLogins int
+	LockedUntil  *time.Time
+}
+
+func (db *appdbimpl) GetUserCredentials(userID string) (*Credentials, error) {
+	row := db.c.QueryRow(`
+		SELECT id, password_hash, failed_logins, locked_until
+		FROM users
+		WHERE id = ?`, userID)
+	var c Credentials
+	if err := row.Scan(&c.UserID, &c.PasswordHash, &c.FailedLogins, &c.LockedUntil); err != nil {
+		return nil, err // può essere sql.ErrNoRows
+	}
+	return &c, nil
+}
+
+func (db *appdbimpl) SetUserPassword(userID, passwordHash string) error {
+	_, err := db.c.Exec(`
+		UPDATE users
+		SET password_hash = ?, failed_logins = 0, locked_until = NULL
+		WHERE id = ?`, passwordHash, userID)
+	return err
+}
+
+// RecordLoginFailure increments the failed login counter. When the counter reaches maxFailures, the account is locked
+// until lockUntil and the counter starts again from zero.
+func (db *appdbimpl) RecordLoginFailure(userID string, maxFailures int, lockUntil time.Time) error {
+	_, err := db.c.Exec(`
+		UPDATE users
+		SET failed_logins = CASE WHEN failed_logins + 1 >= ? THEN 0 ELSE failed_logins + 1 END,
+		    locked_until  = CASE WHEN failed_logins + 1 >= ? THEN ? ELSE locked_until END
+		WHERE id = ?`,
+		maxFailures, maxFailures, lockUntil, userID)
+	return err
+}
+
+func (db *appdbimpl) ResetLoginFailures(userID string) error {
+	_, err := db.c.Exec(`UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = ?`, userID)
+	return err
+}
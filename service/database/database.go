@@ -34,6 +34,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 )
 
 // AppDatabase is the high level interface for the DB
@@ -45,7 +46,29 @@ type AppDatabase interface {
 	GetUserByUsername(username string) (*User, error)
 	SetUserPhoto(userID, photoPath string) error
 	SetUsername(userID, newUsername string) error
-	ListMessageComments(messageID int) ([]Comment, error)
+	GetUserCredentials(userID string) (*Credentials, error)
+	SetUserPassword(userID, passwordHash string) error
+	RecordLoginFailure(userID string, maxFailures int, lockUntil time.Time) error
+	ResetLoginFailures(userID string) error
+	GetUserIDByIdentity(issuer, subject string) (string, error)
+	CreateUserWithIdentity(id, username, issuer, subject string) error
+	HasIdentity(userID string) (bool, error)
+
+	//bot
+	CreateBot(id, name, ownerID string) error
+	ListBots(ownerID string) ([]User, error)
+	CreateAPIKey(k APIKey) error
+	GetAPIKey(id string) (*APIKey, error)
+	TouchAPIKey(id string, lastUsed time.Time) error
+	RevokeAPIKey(id, botID string, at time.Time) (bool, error)
+
+	//2fa
+	GetTOTP(userID string) (*TOTP, error)
+	SetPendingTOTP(userID, secret string) error
+	EnableTOTP(userID string, counter int64, recoveryCodeHashes []string) error
+	DisableTOTP(userID string) error
+	UseTOTPCounter(userID string, counter int64) (bool, error)
+	UseRecoveryCode(userID, codeHash string, at time.Time) (bool, error)
 
 	//group
 	SendMessage(sender_id string, conversation_id int, text string) error
@@ -53,23 +76,95 @@ type AppDatabase interface {
 	AddUserToConversation(conversationID int, userID string) error
 	GetConversationInfo(id int) (*ConversationInfo, error)
 	IsUserInConversation(conversationID int, userID string) (bool, error)
-	InsertMessage(conversation_id int, sender_id, text string) (int, error)
+	InsertMessage(m NewMessage, at time.Time) (int, error)
 	FindDirectConversation(userA, userB string) (int, error)
 	CreateDirectConversation(userA, userB string, name string) (int, error)
-	GetMyConversations(userID string) ([]ConversationSummary, error)
+	GetMyConversations(userID string, now time.Time) ([]ConversationSummary, error)
 	GetMessageByID(id int) (*Message, error)
-	DeleteMessage(id int, authorID string) (bool, error)
-	RemoveUserFromConversation(conversationID int, userID string) (bool, error)
+	DeleteMessage(id int, authorID string, at time.Time) (bool, error)
+	HideMessage(messageID int, userID string, at time.Time) error
+	PurgeDeletedMessages(before time.Time) ([]string, error)
+	EditMessage(id int, authorID, text string, entities []TextEntity, mentions []Mention, links []string, at time.Time) (bool, error)
+	ListMessageEdits(messageID int) ([]MessageEdit, error)
+	ListThreadReplies(rootID int, userID string, afterID, limit int, now time.Time) ([]Message, error)
+	GetThreadSummaries(conversationID int, now time.Time) (map[int]ThreadSummary, error)
+	RemoveUserFromConversation(conversationID int, userID string, at time.Time) (bool, error)
 	UpdateConversationName(id int, name string) error
-	UpsertComment(messageID int, userID, comment string) (int, error)
-	DeleteComment(messageID int, userID string) (bool, error)
+	SetMessageTTL(conversationID, seconds int) error
+	PurgeExpiredMessages(now time.Time) ([]string, error)
 
 	GetConversationParticipants(conversationID int) ([]string, error)
-	ListConversationMessages(conversationID int) ([]Message, error)
+	ListConversationMessages(conversationID int, userID string, now time.Time) ([]Message, error)
+	ListQuotedMessages(conversationID int) (map[int]Message, error)
 	ListUsers(q string) ([]User, error)
 
 	SetConversationPhoto(conversationID int, photoPath string) error
 
+	//scheduled
+	CreateScheduledMessage(s ScheduledMessage) (int, error)
+	ListScheduledMessages(senderID string) ([]ScheduledMessage, error)
+	ListDueScheduledMessages(now time.Time, maxAttempts, limit int) ([]ScheduledMessage, error)
+	TakeScheduledMessage(id int) (*ScheduledMessage, error)
+	SendScheduledMessage(id int, m NewMessage, at time.Time) (int, error)
+	RecordScheduledFailure(id int) error
+	CancelScheduledMessage(id int, senderID string) (*ScheduledMessage, error)
+
+	//reactions
+	AddReaction(messageID int, userID, emoji string, at time.Time) (bool, error)
+	SetReaction(messageID int, userID, emoji string, at time.Time) (int, error)
+	RemoveReaction(messageID int, userID, emoji string) (bool, error)
+	ListConversationReactions(conversationID int) (map[int][]Reaction, error)
+
+	//pins
+	PinMessage(conversationID, messageID int, userID string, at time.Time, limit int) (bool, error)
+	UnpinMessage(conversationID, messageID int) (bool, error)
+	ListPins(conversationID int, now time.Time) ([]Pin, error)
+
+	//formatting
+	ListMessageEntities(messageID int) ([]TextEntity, error)
+	ListConversationEntities(conversationID int) (map[int][]TextEntity, error)
+
+	//polls
+	CreatePoll(msg NewMessage, p NewPoll, at time.Time) (int, int, error)
+	GetPoll(id int) (*Poll, error)
+	GetPollByMessage(messageID int) (*Poll, error)
+	ListConversationPolls(conversationID int) (map[int]*Poll, error)
+	SetPollVotes(pollID int, userID string, options []int, at time.Time) (bool, error)
+	ClosePoll(id int, at time.Time) (bool, error)
+
+	//drafts
+	SaveDraft(conversationID int, userID, text string, at time.Time) error
+	GetDraft(conversationID int, userID string) (*Draft, error)
+	DeleteDraft(conversationID int, userID string) (bool, error)
+
+	//link previews
+	ListPendingLinks(retryBefore time.Time, limit int) ([]string, error)
+	SaveLinkPreview(p LinkPreview) error
+	ListConversationPreviews(conversationID int) (map[int][]LinkPreview, error)
+
+	//mentions
+	ListConversationMentions(conversationID int) (map[int][]Mention, error)
+	ListMentions(userID string, beforeID, limit int, now time.Time) ([]UserMention, error)
+
+	//stars
+	StarMessage(messageID int, userID string, at time.Time) (bool, error)
+	UnstarMessage(messageID int, userID string) (bool, error)
+	ListStars(userID string, beforeID, limit int, now time.Time) ([]Star, error)
+	GetStarredMessageIDs(conversationID int, userID string) (map[int]bool, error)
+
+	//receipts
+	MarkDelivered(userID string, conversationID int, at time.Time) error
+	MarkRead(userID string, conversationID, messageID int, at time.Time) error
+	GetReceiptSummaries(conversationID int) (map[int]ReceiptSummary, error)
+
+	//session
+	CreateSession(s Session) error
+	GetSession(id string) (*Session, error)
+	TouchSession(id string, lastSeen time.Time) error
+	ListActiveSessions(userID string, now time.Time) ([]Session, error)
+	RevokeSession(id, userID string, at time.Time) (bool, error)
+	RevokeOtherSessions(userID, keepID string, at time.Time) (int, error)
+
 	Ping() error
 }
 
@@ -121,6 +216,28 @@ func New(db *sql.DB) (AppDatabase, error) {
 		}
 	}
 
+	// credentials (optional, only for claimed accounts), kind (human or bot) and second factor
+	for _, col := range []struct{ name, def string }{
+		{"password_hash", "TEXT"},
+		{"failed_logins", "INTEGER NOT NULL DEFAULT 0"},
+		{"locked_until", "DATETIME"},
+		{"kind", "TEXT NOT NULL DEFAULT 'human'"},
+		{"owner_id", "TEXT REFERENCES users(id)"},
+		{"totp_secret", "TEXT"},
+		{"totp_enabled", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"totp_last_counter", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		var hasCol int
+		err = db.QueryRow(`SELECT 1 FROM pragma_table_info('users') WHERE name=?`, col.name).Scan(&hasCol)
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err := db.Exec(`ALTER TABLE users ADD COLUMN ` + col.name + ` ` + col.def); err != nil {
+				return nil, fmt.Errorf("adding users.%s: %w", col.name, err)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("checking users.%s: %w", col.name, err)
+		}
+	}
+
 	//photo
 	var hasPhotoCol int
 	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('conversations') WHERE name='photo'`).Scan(&hasPhotoCol)
@@ -132,6 +249,17 @@ func New(db *sql.DB) (AppDatabase, error) {
 		return nil, fmt.Errorf("checking conversations.photo: %w", err)
 	}
 
+	// timer of disappearing messages, in seconds (0 = off)
+	var hasTTLCol int
+	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('conversations') WHERE name='message_ttl'`).Scan(&hasTTLCol)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`ALTER TABLE conversations ADD COLUMN message_ttl INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return nil, fmt.Errorf("adding conversations.message_ttl: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking conversations.message_ttl: %w", err)
+	}
+
 	//user_conversations
 	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='user_conversations';`).Scan(&tableName)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -169,23 +297,465 @@ func New(db *sql.DB) (AppDatabase, error) {
 		}
 	}
 
-	// comments
-	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_comments';`).Scan(&tableName)
+	// photo of photo messages (the text is the caption, possibly empty)
+	var hasPhoto int
+	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('messages') WHERE name='photo'`).Scan(&hasPhoto)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN photo TEXT`); err != nil {
+			return nil, fmt.Errorf("adding messages.photo: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking messages.photo: %w", err)
+	}
+
+	// quoted message of replies. No foreign key: the reply must survive the deletion of the quoted message
+	var hasReplyTo int
+	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('messages') WHERE name='reply_to_id'`).Scan(&hasReplyTo)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN reply_to_id INTEGER`); err != nil {
+			return nil, fmt.Errorf("adding messages.reply_to_id: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking messages.reply_to_id: %w", err)
+	}
+
+	// root message of thread replies (NULL for the messages of the main list)
+	var hasThreadRoot int
+	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('messages') WHERE name='thread_root_id'`).Scan(&hasThreadRoot)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`
+			ALTER TABLE messages ADD COLUMN thread_root_id INTEGER REFERENCES messages(id) ON DELETE CASCADE;
+			CREATE INDEX messages_thread_root ON messages (thread_root_id);`); err != nil {
+			return nil, fmt.Errorf("adding messages.thread_root_id: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking messages.thread_root_id: %w", err)
+	}
+
+	// provenance of forwarded messages: the original message (no foreign key, it can be deleted), its sender and
+	// time, and how many times it was forwarded along the chain
+	for _, col := range []struct{ name, def string }{
+		{"forwarded_from_id", "INTEGER"},
+		{"forwarded_sender_id", "TEXT"},
+		{"forwarded_at", "DATETIME"},
+		{"forward_count", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		var hasCol int
+		err = db.QueryRow(`SELECT 1 FROM pragma_table_info('messages') WHERE name=?`, col.name).Scan(&hasCol)
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN ` + col.name + ` ` + col.def); err != nil {
+				return nil, fmt.Errorf("adding messages.%s: %w", col.name, err)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("checking messages.%s: %w", col.name, err)
+		}
+	}
+
+	// deletion time of tombstones (messages deleted for everyone)
+	var hasDeletedAt int
+	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('messages') WHERE name='deleted_at'`).Scan(&hasDeletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN deleted_at DATETIME`); err != nil {
+			return nil, fmt.Errorf("adding messages.deleted_at: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking messages.deleted_at: %w", err)
+	}
+
+	// messages deleted only for some users
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_hidden';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_hidden (
+			message_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			hidden_at DATETIME NOT NULL,
+			PRIMARY KEY (message_id, user_id),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_hidden table: %w", err)
+		}
+	}
+
+	// expiration time of disappearing messages
+	var hasExpiresAt int
+	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('messages') WHERE name='expires_at'`).Scan(&hasExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`
+			ALTER TABLE messages ADD COLUMN expires_at DATETIME;
+			CREATE INDEX messages_expires_at ON messages (expires_at);`); err != nil {
+			return nil, fmt.Errorf("adding messages.expires_at: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking messages.expires_at: %w", err)
+	}
+
+	// messages waiting to be sent
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='scheduled_messages';`).Scan(&tableName)
 	if errors.Is(err, sql.ErrNoRows) {
 		sqlStmt := `
-		CREATE TABLE message_comments (
+		CREATE TABLE scheduled_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			conversation_id INTEGER NOT NULL,
+			sender_id TEXT NOT NULL,
+			text TEXT NOT NULL,
+			photo TEXT,
+			reply_to_id INTEGER,
+			scheduled_at DATETIME NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+			FOREIGN KEY (sender_id) REFERENCES users(id)
+		);
+		CREATE INDEX scheduled_messages_due ON scheduled_messages (scheduled_at);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating scheduled_messages table: %w", err)
+		}
+	}
+
+	// failed attempts to send a scheduled message
+	var hasAttempts int
+	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('scheduled_messages') WHERE name='attempts'`).Scan(&hasAttempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`ALTER TABLE scheduled_messages ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return nil, fmt.Errorf("adding scheduled_messages.attempts: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking scheduled_messages.attempts: %w", err)
+	}
+
+	// reactions (several distinct emoji per user and message)
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_reactions';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_reactions (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			message_id INTEGER NOT NULL,
 			user_id TEXT NOT NULL,
-			comment TEXT NOT NULL,
-			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE (message_id, user_id),
+			emoji TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			UNIQUE (message_id, user_id, emoji),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_reactions table: %w", err)
+		}
+		if err := migrateComments(db); err != nil {
+			return nil, fmt.Errorf("migrating message_comments: %w", err)
+		}
+	}
+
+	// messages pinned in their conversation
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_pins';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_pins (
+			conversation_id INTEGER NOT NULL,
+			message_id INTEGER NOT NULL,
+			pinned_by TEXT NOT NULL,
+			pinned_at DATETIME NOT NULL,
+			PRIMARY KEY (conversation_id, message_id),
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (pinned_by) REFERENCES users(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_pins table: %w", err)
+		}
+	}
+
+	// formatting of the text of messages
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_entities';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_entities (
+			message_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			utf16_offset INTEGER NOT NULL,
+			utf16_length INTEGER NOT NULL,
+			url TEXT NOT NULL DEFAULT '',
+			language TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (message_id, position),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_entities table: %w", err)
+		}
+	}
+
+	// polls, with their options and votes
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='polls';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE polls (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INTEGER NOT NULL UNIQUE,
+			conversation_id INTEGER NOT NULL,
+			creator_id TEXT NOT NULL,
+			question TEXT NOT NULL,
+			multiple_choice INTEGER NOT NULL,
+			anonymous INTEGER NOT NULL,
+			closes_at DATETIME,
+			closed_at DATETIME,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+			FOREIGN KEY (creator_id) REFERENCES users(id)
+		);
+		CREATE TABLE poll_options (
+			poll_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			text TEXT NOT NULL,
+			PRIMARY KEY (poll_id, position),
+			FOREIGN KEY (poll_id) REFERENCES polls(id) ON DELETE CASCADE
+		);
+		CREATE TABLE poll_votes (
+			poll_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			voted_at DATETIME NOT NULL,
+			PRIMARY KEY (poll_id, position, user_id),
+			FOREIGN KEY (poll_id, position) REFERENCES poll_options(poll_id, position) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating polls table: %w", err)
+		}
+	}
+
+	// drafts, one per user and conversation
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_drafts';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_drafts (
+			conversation_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			text TEXT NOT NULL,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (conversation_id, user_id),
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_drafts table: %w", err)
+		}
+	}
+
+	// links of messages, and the cache of their previews
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_links';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_links (
+			message_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			url TEXT NOT NULL,
+			PRIMARY KEY (message_id, position),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+		);
+		CREATE INDEX message_links_url ON message_links (url);
+		CREATE TABLE link_previews (
+			url TEXT PRIMARY KEY,
+			title TEXT NOT NULL,
+			description TEXT NOT NULL,
+			image_url TEXT NOT NULL,
+			site_name TEXT NOT NULL,
+			ok INTEGER NOT NULL,
+			fetched_at DATETIME NOT NULL
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_links table: %w", err)
+		}
+	}
+
+	// users mentioned in messages
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_mentions';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_mentions (
+			message_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			utf16_offset INTEGER NOT NULL,
+			utf16_length INTEGER NOT NULL,
+			PRIMARY KEY (message_id, utf16_offset),
 			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
 			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+		CREATE INDEX message_mentions_user ON message_mentions (user_id);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_mentions table: %w", err)
+		}
+	}
+
+	// messages bookmarked by each user
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_stars';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_stars (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			message_id INTEGER NOT NULL,
+			starred_at DATETIME NOT NULL,
+			UNIQUE (user_id, message_id),
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
 		);`
 		_, err = db.Exec(sqlStmt)
 		if err != nil {
-			return nil, fmt.Errorf("error creating message_comments table: %w", err)
+			return nil, fmt.Errorf("error creating message_stars table: %w", err)
+		}
+	}
+
+	// edit time of edited messages
+	var hasEditedAt int
+	err = db.QueryRow(`SELECT 1 FROM pragma_table_info('messages') WHERE name='edited_at'`).Scan(&hasEditedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN edited_at DATETIME`); err != nil {
+			return nil, fmt.Errorf("adding messages.edited_at: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking messages.edited_at: %w", err)
+	}
+
+	// previous versions of edited messages
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_edits';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_edits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INTEGER NOT NULL,
+			text TEXT NOT NULL,
+			replaced_at DATETIME NOT NULL,
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+		);
+		CREATE INDEX message_edits_message ON message_edits (message_id);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_edits table: %w", err)
+		}
+	}
+
+	// receipts (one row per message and recipient)
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_receipts';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE message_receipts (
+			message_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			delivered_at DATETIME,
+			read_at DATETIME,
+			PRIMARY KEY (message_id, user_id),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message_receipts table: %w", err)
+		}
+	}
+
+	// messages of a conversation in order, to find the last one delivered to a user
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='index' AND name='messages_conversation';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.Exec(`CREATE INDEX messages_conversation ON messages (conversation_id, id)`); err != nil {
+			return nil, fmt.Errorf("error creating messages_conversation index: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking messages_conversation index: %w", err)
+	}
+
+	// sessions
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='sessions';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			device TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			revoked_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+		CREATE INDEX sessions_user_id ON sessions (user_id);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating sessions table: %w", err)
+		}
+	}
+
+	// external identities (OpenID Connect)
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='user_identities';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE user_identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (issuer, subject),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating user_identities table: %w", err)
+		}
+	}
+
+	// api keys (bots)
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='api_keys';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE api_keys (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			secret_hash TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME,
+			revoked_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+		CREATE TABLE api_key_conversations (
+			key_id TEXT NOT NULL,
+			conversation_id INTEGER NOT NULL,
+			PRIMARY KEY (key_id, conversation_id),
+			FOREIGN KEY (key_id) REFERENCES api_keys(id) ON DELETE CASCADE,
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating api_keys table: %w", err)
+		}
+	}
+
+	// recovery codes of the second factor
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='recovery_codes';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		sqlStmt := `
+		CREATE TABLE recovery_codes (
+			user_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			PRIMARY KEY (user_id, code_hash),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating recovery_codes table: %w", err)
 		}
 	}
 
@@ -255,12 +825,14 @@ func (db *appdbimpl) AddUserToConversation(conversationID int, userID string) er
 type ConversationInfo struct {
 	ID      int
 	IsGroup bool
+	// MessageTTL is how long the new messages last, in seconds (0 = forever)
+	MessageTTL int
 }
 
 func (db *appdbimpl) GetConversationInfo(id int) (*ConversationInfo, error) {
-	row := db.c.QueryRow(`SELECT id, is_group FROM conversations WHERE id = ?`, id)
+	row := db.c.QueryRow(`SELECT id, is_group, message_ttl FROM conversations WHERE id = ?`, id)
 	var info ConversationInfo
-	if err := row.Scan(&info.ID, &info.IsGroup); err != nil {
+	if err := row.Scan(&info.ID, &info.IsGroup, &info.MessageTTL); err != nil {
 		return nil, err // può essere sql.ErrNoRows
 	}
 	return &info, nil
@@ -284,11 +856,40 @@ func (db *appdbimpl) IsUserInConversation(conversationID int, userID string) (bo
 	return true, nil
 }
 
-func (db *appdbimpl) InsertMessage(conversation_id int, sender_id, text string) (int, error) {
-	res, err := db.c.Exec(`
-        INSERT INTO messages (conversation_id, sender_id, text)
-        VALUES (?, ?, ?)`,
-		conversation_id, sender_id, text)
+// InsertMessage stores a new message sent at the given time. If the conversation has a message timer, the message
+// expires after it.
+func (db *appdbimpl) InsertMessage(m NewMessage, at time.Time) (int, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	id, err := insertMessage(tx, m, at)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// insertMessage stores a new message, sent at the given time, in the transaction and returns its ID
+func insertMessage(tx *sql.Tx, m NewMessage, at time.Time) (int, error) {
+	var ttl int
+	if err := tx.QueryRow(`SELECT message_ttl FROM conversations WHERE id = ?`, m.ConversationID).Scan(&ttl); err != nil {
+		return 0, err
+	}
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := at.UTC().Add(time.Duration(ttl) * time.Second)
+		expiresAt = &t
+	}
+
+	res, err := tx.Exec(`
+        INSERT INTO messages (conversation_id, sender_id, text, photo, reply_to_id, thread_root_id,
+                              forwarded_from_id, forwarded_sender_id, forwarded_at, forward_count, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.ConversationID, m.SenderID, m.Text, m.Photo, m.ReplyToID, m.ThreadRootID,
+		m.ForwardedFromID, m.ForwardedSenderID, m.ForwardedAt, m.ForwardCount, expiresAt)
 	if err != nil {
 		return 0, err
 	}
@@ -296,6 +897,15 @@ func (db *appdbimpl) InsertMessage(conversation_id int, sender_id, text string)
 	if err != nil {
 		return 0, err
 	}
+	if err := insertEntities(tx, int(id), m.Entities); err != nil {
+		return 0, err
+	}
+	if err := insertMentions(tx, int(id), m.Mentions); err != nil {
+		return 0, err
+	}
+	if err := insertLinks(tx, int(id), m.Links); err != nil {
+		return 0, err
+	}
 	return int(id), nil
 }
 
@@ -326,7 +936,7 @@ func (db *appdbimpl) CreateDirectConversation(userA, userB string, name string)
 	return id, nil
 }
 
-func (db *appdbimpl) GetMyConversations(userID string) ([]ConversationSummary, error) {
+func (db *appdbimpl) GetMyConversations(userID string, now time.Time) ([]ConversationSummary, error) {
 	const q = `
 		SELECT
 		c.id,
@@ -342,16 +952,29 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]ConversationSummary, e
 		END AS display_name,
 		c.is_group,
 		(
-			SELECT m.text
+			SELECT CASE WHEN m.deleted_at IS NULL THEN m.text END
 			FROM messages m
-			WHERE m.conversation_id = c.id
+			WHERE m.conversation_id = c.id AND m.thread_root_id IS NULL
+			  AND m.id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = uc.user_id)
+			  AND (m.expires_at IS NULL OR m.expires_at > ?)
 			ORDER BY m.timestamp DESC
 			LIMIT 1
 		) AS last_text,
+		COALESCE((
+			SELECT m.photo IS NOT NULL AND m.deleted_at IS NULL
+			FROM messages m
+			WHERE m.conversation_id = c.id AND m.thread_root_id IS NULL
+			  AND m.id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = uc.user_id)
+			  AND (m.expires_at IS NULL OR m.expires_at > ?)
+			ORDER BY m.timestamp DESC
+			LIMIT 1
+		), 0) AS last_photo,
 		(
 			SELECT strftime('%Y-%m-%dT%H:%M:%SZ', m.timestamp)
 			FROM messages m
-			WHERE m.conversation_id = c.id
+			WHERE m.conversation_id = c.id AND m.thread_root_id IS NULL
+			  AND m.id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = uc.user_id)
+			  AND (m.expires_at IS NULL OR m.expires_at > ?)
 			ORDER BY m.timestamp DESC
 			LIMIT 1
 		) AS last_ts,
@@ -364,13 +987,27 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]ConversationSummary, e
 			WHERE uc2.conversation_id = c.id AND uc2.user_id <> ?
 			LIMIT 1
 			)
-		END AS photo_url
+		END AS photo_url,
+		(
+			SELECT COUNT(DISTINCT m.id)
+			FROM message_mentions mm
+			JOIN messages m ON m.id = mm.message_id
+			WHERE mm.user_id = uc.user_id AND m.conversation_id = c.id AND m.deleted_at IS NULL
+			  AND m.id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = uc.user_id)
+			  AND (m.expires_at IS NULL OR m.expires_at > ?)
+			  AND NOT EXISTS (
+				SELECT 1 FROM message_receipts r
+				WHERE r.message_id = m.id AND r.user_id = uc.user_id AND r.read_at IS NOT NULL)
+		) AS mention_count,
+		d.text AS draft_text,
+		d.updated_at AS draft_at
 		FROM conversations c
 		JOIN user_conversations uc ON uc.conversation_id = c.id
+		LEFT JOIN message_drafts d ON d.conversation_id = c.id AND d.user_id = uc.user_id
 		WHERE uc.user_id = ?
 		ORDER BY COALESCE(last_ts, strftime('%Y-%m-%dT%H:%M:%SZ', c.timestamp)) DESC
     `
-	rows, err := db.c.Query(q, userID, userID, userID)
+	rows, err := db.c.Query(q, userID, now, now, now, userID, now, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -379,9 +1016,15 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]ConversationSummary, e
 	out := []ConversationSummary{}
 	for rows.Next() {
 		var it ConversationSummary
-		if err := rows.Scan(&it.ID, &it.Name, &it.IsGroup, &it.LastText, &it.LastAtISO, &it.Photo); err != nil {
+		var draftText sql.NullString
+		var draftAt sql.NullTime
+		if err := rows.Scan(&it.ID, &it.Name, &it.IsGroup, &it.LastText, &it.LastPhoto, &it.LastAtISO, &it.Photo, &it.Mentions,
+			&draftText, &draftAt); err != nil {
 			return nil, err
 		}
+		if draftText.Valid && draftAt.Valid {
+			it.Draft = &Draft{Text: draftText.String, UpdatedAt: draftAt.Time}
+		}
 		out = append(out, it)
 	}
 	if err := rows.Err(); err != nil {
@@ -390,80 +1033,175 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]ConversationSummary, e
 	return out, nil
 }
 
+// messageColumns are the columns read by scanMessage, in order
+const messageColumns = `id, conversation_id, sender_id, text, photo, reply_to_id, thread_root_id, timestamp, edited_at,
+	forwarded_from_id, forwarded_sender_id, forwarded_at, forward_count, deleted_at, expires_at`
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessage(row scanner) (Message, error) {
+	var m Message
+	err := row.Scan(&m.ID, &m.ConversationID, &m.SenderID, &m.Text, &m.Photo, &m.ReplyToID, &m.ThreadRootID,
+		&m.Timestamp, &m.EditedAt, &m.ForwardedFromID, &m.ForwardedSenderID, &m.ForwardedAt, &m.ForwardCount,
+		&m.DeletedAt, &m.ExpiresAt)
+	return m, err
+}
+
 func (db *appdbimpl) GetMessageByID(id int) (*Message, error) {
 	row := db.c.QueryRow(`
-        SELECT id, conversation_id, sender_id, text, timestamp
+        SELECT `+messageColumns+`
         FROM messages
         WHERE id = ?`,
 		id,
 	)
-	var m Message
-	if err := row.Scan(&m.ID, &m.ConversationID, &m.SenderID, &m.Text, &m.Timestamp); err != nil {
+	m, err := scanMessage(row)
+	if err != nil {
 		return nil, err
 	}
 	return &m, nil
 }
 
-func (db *appdbimpl) DeleteMessage(id int, authorID string) (bool, error) {
-	res, err := db.c.Exec(`DELETE FROM messages WHERE id = ? AND sender_id = ?`, id, authorID)
+// DeleteMessage deletes the message for everyone, leaving a tombstone: its text, formatting, mentions, links, poll,
+// reactions and edit history are removed right away, together with its pin. Only the photo stays until the purge (see
+// PurgeDeletedMessages), which also removes its file. It returns false if the message does not exist, the author does
+// not match or it was already deleted.
+func (db *appdbimpl) DeleteMessage(id int, authorID string, at time.Time) (bool, error) {
+	tx, err := db.c.Begin()
 	if err != nil {
 		return false, err
 	}
-	aff, err := res.RowsAffected()
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`
+		UPDATE messages SET deleted_at = ?, text = ''
+		WHERE id = ? AND sender_id = ? AND deleted_at IS NULL`, at, id, authorID)
 	if err != nil {
 		return false, err
 	}
-	return aff > 0, nil
+	aff, err := res.RowsAffected()
+	if err != nil || aff == 0 {
+		return false, err
+	}
+
+	// i contenuti spariscono subito, non solo dalla vista; un messaggio cancellato non resta fissato
+	for _, q := range []string{
+		`DELETE FROM message_edits WHERE message_id = ?`,
+		`DELETE FROM message_entities WHERE message_id = ?`,
+		`DELETE FROM message_mentions WHERE message_id = ?`,
+		`DELETE FROM message_links WHERE message_id = ?`,
+		`DELETE FROM message_reactions WHERE message_id = ?`,
+		`DELETE FROM polls WHERE message_id = ?`,
+		`DELETE FROM message_pins WHERE message_id = ?`,
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
 }
 
-func (db *appdbimpl) RemoveUserFromConversation(conversationID int, userID string) (bool, error) {
-	res, err := db.c.Exec(
-		`DELETE FROM user_conversations WHERE conversation_id = ? AND user_id = ?`,
-		conversationID, userID,
-	)
+// EditMessage replaces the text of the message, keeping the previous one in the edit history. It returns false if the
+// message does not exist or the author does not match. The formatting, the mentions and the links of the message are
+// replaced with the given ones.
+func (db *appdbimpl) EditMessage(id int, authorID, text string, entities []TextEntity, mentions []Mention, links []string, at time.Time) (bool, error) {
+	tx, err := db.c.Begin()
 	if err != nil {
 		return false, err
 	}
-	aff, err := res.RowsAffected()
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`
+		INSERT INTO message_edits (message_id, text, replaced_at)
+		SELECT id, text, ?
+		FROM messages
+		WHERE id = ? AND sender_id = ? AND deleted_at IS NULL`, at, id, authorID)
 	if err != nil {
 		return false, err
 	}
-	return aff > 0, nil
-}
-
-func (db *appdbimpl) UpdateConversationName(id int, name string) error {
-	_, err := db.c.Exec(`UPDATE conversations SET name = ? WHERE id = ?`, name, id)
-	return err
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE messages SET text = ?, edited_at = ? WHERE id = ?`, text, at, id); err != nil {
+		return false, err
+	}
+	if err := insertEntities(tx, id, entities); err != nil {
+		return false, err
+	}
+	if err := insertMentions(tx, id, mentions); err != nil {
+		return false, err
+	}
+	if err := insertLinks(tx, id, links); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
 
-func (db *appdbimpl) UpsertComment(messageID int, userID, comment string) (int, error) {
-	row := db.c.QueryRow(`
-		INSERT INTO message_comments (message_id, user_id, comment)
-		VALUES (?, ?, ?)
-		ON CONFLICT(message_id, user_id) DO UPDATE
-			SET comment = excluded.comment,
-			    timestamp = CURRENT_TIMESTAMP
-		RETURNING id
-	`, messageID, userID, comment)
+// ListMessageEdits returns the previous versions of the message, oldest first
+func (db *appdbimpl) ListMessageEdits(messageID int) ([]MessageEdit, error) {
+	rows, err := db.c.Query(`
+		SELECT text, replaced_at
+		FROM message_edits
+		WHERE message_id = ?
+		ORDER BY id`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	var id int
-	if err := row.Scan(&id); err != nil {
-		return 0, err
+	out := []MessageEdit{}
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.Text, &e.ReplacedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
 	}
-	return id, nil
+	return out, rows.Err()
 }
 
-func (db *appdbimpl) DeleteComment(messageID int, userID string) (bool, error) {
-	res, err := db.c.Exec(`DELETE FROM message_comments WHERE message_id = ? AND user_id = ?`,
-		messageID, userID)
+// RemoveUserFromConversation removes the user from the members of the conversation, together with their draft and
+// their votes in the polls of the conversation still open at the given time
+func (db *appdbimpl) RemoveUserFromConversation(conversationID int, userID string, at time.Time) (bool, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(
+		`DELETE FROM user_conversations WHERE conversation_id = ? AND user_id = ?`,
+		conversationID, userID,
+	)
 	if err != nil {
 		return false, err
 	}
 	aff, err := res.RowsAffected()
+	if err != nil || aff == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM message_drafts WHERE conversation_id = ? AND user_id = ?`, conversationID, userID)
 	if err != nil {
 		return false, err
 	}
-	return aff > 0, nil
+	_, err = tx.Exec(`
+		DELETE FROM poll_votes
+		WHERE user_id = ? AND poll_id IN (
+			SELECT id FROM polls
+			WHERE conversation_id = ? AND closed_at IS NULL AND (closes_at IS NULL OR closes_at > ?))`,
+		userID, conversationID, at)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (db *appdbimpl) UpdateConversationName(id int, name string) error {
+	_, err := db.c.Exec(`UPDATE conversations SET name = ? WHERE id = ?`, name, id)
+	return err
 }
 
 func (db *appdbimpl) SetUsername(userID, newUsername string) error {
@@ -507,12 +1245,16 @@ func (db *appdbimpl) GetConversationParticipants(conversationID int) ([]string,
 	return out, nil
 }
 
-func (db *appdbimpl) ListConversationMessages(conversationID int) ([]Message, error) {
+// ListConversationMessages returns the main list of the conversation, newest first, without the messages the user
+// deleted for themselves and the expired ones
+func (db *appdbimpl) ListConversationMessages(conversationID int, userID string, now time.Time) ([]Message, error) {
 	rows, err := db.c.Query(`
-        SELECT id, conversation_id, sender_id, text, timestamp
+        SELECT `+messageColumns+`
         FROM messages
-        WHERE conversation_id = ?
-        ORDER BY timestamp DESC`, conversationID)
+        WHERE conversation_id = ? AND thread_root_id IS NULL
+          AND id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = ?)
+          AND (expires_at IS NULL OR expires_at > ?)
+        ORDER BY timestamp DESC`, conversationID, userID, now)
 	if err != nil {
 		return nil, err
 	}
@@ -520,8 +1262,8 @@ func (db *appdbimpl) ListConversationMessages(conversationID int) ([]Message, er
 
 	var out []Message
 	for rows.Next() {
-		var m Message
-		if err := rows.Scan(&m.ID, &m.ConversationID, &m.SenderID, &m.Text, &m.Timestamp); err != nil {
+		m, err := scanMessage(rows)
+		if err != nil {
 			return nil, err
 		}
 		out = append(out, m)
@@ -532,14 +1274,38 @@ func (db *appdbimpl) ListConversationMessages(conversationID int) ([]Message, er
 	return out, nil
 }
 
+// ListQuotedMessages returns the messages quoted by the replies of the conversation, by ID. Quoted messages that don't
+// exist anymore are not in the map.
+func (db *appdbimpl) ListQuotedMessages(conversationID int) (map[int]Message, error) {
+	rows, err := db.c.Query(`
+        SELECT `+messageColumns+`
+        FROM messages
+        WHERE id IN (SELECT reply_to_id FROM messages WHERE conversation_id = ? AND reply_to_id IS NOT NULL)`,
+		conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int]Message)
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out[m.ID] = m
+	}
+	return out, rows.Err()
+}
+
 func (db *appdbimpl) ListUsers(q string) ([]User, error) {
 	var rows *sql.Rows
 	var err error
 	if q == "" {
-		rows, err = db.c.Query(`SELECT id, username, photo FROM users ORDER BY username`)
+		rows, err = db.c.Query(`SELECT id, username, photo, kind FROM users ORDER BY username`)
 	} else {
 		like := q + "%"
-		rows, err = db.c.Query(`SELECT id, username, photo FROM users WHERE username LIKE ? ORDER BY username`, like)
+		rows, err = db.c.Query(`SELECT id, username, photo, kind FROM users WHERE username LIKE ? ORDER BY username`, like)
 	}
 	if err != nil {
 		return nil, err
@@ -549,7 +1315,7 @@ func (db *appdbimpl) ListUsers(q string) ([]User, error) {
 	var out []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.PhotoURL); err != nil {
+		if err := rows.Scan(&u.ID, &u.Username, &u.PhotoURL, &u.Kind); err != nil {
 			return nil, err
 		}
 		out = append(out, u)
@@ -560,29 +1326,6 @@ func (db *appdbimpl) ListUsers(q string) ([]User, error) {
 	return out, nil
 }
 
-func (db *appdbimpl) ListMessageComments(messageID int) ([]Comment, error) {
-	rows, err := db.c.Query(`
-        SELECT message_id, user_id, comment, timestamp
-        FROM message_comments
-        WHERE message_id = ?
-        ORDER BY timestamp ASC
-    `, messageID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var out []Comment
-	for rows.Next() {
-		var c Comment
-		if err := rows.Scan(&c.MessageID, &c.UserID, &c.Comment, &c.Timestamp); err != nil {
-			return nil, err
-		}
-		out = append(out, c)
-	}
-	return out, rows.Err()
-}
-
 func (db *appdbimpl) SearchUsersByName(query string) ([]User, error) {
 	rows, err := db.c.Query(`
         SELECT id, username, photo
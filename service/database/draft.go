@@ -0,0 +1,44 @@
+package database
+
+import "time"
+
+// Draft is the message a user is writing in a conversation, saved so that it's available on all their clients
+type Draft struct {
+	Text      string
+	UpdatedAt time.Time
+}
+
+// SaveDraft stores the draft of the user in the conversation, replacing the previous one
+func (db *appdbimpl) SaveDraft(conversationID int, userID, text string, at time.Time) error {
+	_, err := db.c.Exec(`
+		INSERT INTO message_drafts (conversation_id, user_id, text, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (conversation_id, user_id) DO UPDATE SET text = excluded.text, updated_at = excluded.updated_at`,
+		conversationID, userID, text, at)
+	return err
+}
+
+// GetDraft returns the draft of the user in the conversation, or sql.ErrNoRows if there is none
+func (db *appdbimpl) GetDraft(conversationID int, userID string) (*Draft, error) {
+	var d Draft
+	err := db.c.QueryRow(`SELECT text, updated_at FROM message_drafts WHERE conversation_id = ? AND user_id = ?`,
+		conversationID, userID).Scan(&d.Text, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// DeleteDraft removes the draft of the user in the conversation. It returns false if there was none.
+func (db *appdbimpl) DeleteDraft(conversationID int, userID string) (bool, error) {
+	res, err := db.c.Exec(`DELETE FROM message_drafts WHERE conversation_id = ? AND user_id = ?`,
+		conversationID, userID)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
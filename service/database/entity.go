@@ -0,0 +1,78 @@
+package database
+
+import "database/sql"
+
+// TextEntity is a formatted span of the text of a message (see package richtext). Offset and Length are in UTF-16
+// code units.
+type TextEntity struct {
+	Type     string
+	Offset   int
+	Length   int
+	URL      string
+	Language string
+}
+
+// insertEntities stores the formatting of the message, replacing the previous one
+func insertEntities(tx *sql.Tx, messageID int, entities []TextEntity) error {
+	if _, err := tx.Exec(`DELETE FROM message_entities WHERE message_id = ?`, messageID); err != nil {
+		return err
+	}
+	for i, e := range entities {
+		_, err := tx.Exec(`
+			INSERT INTO message_entities (message_id, position, type, utf16_offset, utf16_length, url, language)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, messageID, i, e.Type, e.Offset, e.Length, e.URL, e.Language)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListConversationEntities returns the formatting of the messages of the conversation, by message ID, in the order it
+// was stored
+func (db *appdbimpl) ListConversationEntities(conversationID int) (map[int][]TextEntity, error) {
+	rows, err := db.c.Query(`
+		SELECT e.message_id, e.type, e.utf16_offset, e.utf16_length, e.url, e.language
+		FROM message_entities e
+		JOIN messages m ON m.id = e.message_id
+		WHERE m.conversation_id = ?
+		ORDER BY e.message_id, e.position`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int][]TextEntity)
+	for rows.Next() {
+		var id int
+		var e TextEntity
+		if err := rows.Scan(&id, &e.Type, &e.Offset, &e.Length, &e.URL, &e.Language); err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], e)
+	}
+	return out, rows.Err()
+}
+
+// ListMessageEntities returns the formatting of the message, in the order it was stored
+func (db *appdbimpl) ListMessageEntities(messageID int) ([]TextEntity, error) {
+	rows, err := db.c.Query(`
+		SELECT type, utf16_offset, utf16_length, url, language
+		FROM message_entities
+		WHERE message_id = ?
+		ORDER BY position`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []TextEntity
+	for rows.Next() {
+		var e TextEntity
+		if err := rows.Scan(&e.Type, &e.Offset, &e.Length, &e.URL, &e.Language); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,60 @@
+package database
+
+import "time"
+
+// SetMessageTTL sets the timer of the disappearing messages of the conversation, in seconds (0 turns it off). It
+// applies to the messages sent from now on.
+func (db *appdbimpl) SetMessageTTL(conversationID, seconds int) error {
+	_, err := db.c.Exec(`UPDATE conversations SET message_ttl = ? WHERE id = ?`, seconds, conversationID)
+	return err
+}
+
+// PurgeExpiredMessages deletes the messages expired at the given time, with everything attached to them. It returns the
+// URLs of the photos that are not used by any message anymore, so that their files can be removed.
+func (db *appdbimpl) PurgeExpiredMessages(now time.Time) ([]string, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// anche le foto delle risposte nei thread, che vanno via con la radice
+	rows, err := tx.Query(`
+		SELECT DISTINCT photo
+		FROM messages
+		WHERE photo IS NOT NULL AND (expires_at <= ? OR thread_root_id IN (
+			SELECT id FROM messages WHERE expires_at <= ?))`, now, now)
+	if err != nil {
+		return nil, err
+	}
+	var photos []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		photos = append(photos, p)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// reazioni, modifiche, ricevute e risposte nei thread vanno via in cascata
+	if _, err := tx.Exec(`DELETE FROM messages WHERE expires_at <= ?`, now); err != nil {
+		return nil, err
+	}
+
+	var unused []string
+	for _, p := range photos {
+		var uses int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM messages WHERE photo = ?`, p).Scan(&uses); err != nil {
+			return nil, err
+		}
+		if uses == 0 {
+			unused = append(unused, p)
+		}
+	}
+	return unused, tx.Commit()
+}
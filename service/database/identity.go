@@ -0,0 +1,56 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrUsernameTaken is returned by CreateUserWithIdentity when the username belongs to another user
+var ErrUsernameTaken = errors.New("username already taken")
+
+// GetUserIDByIdentity returns the user linked to the subject of an external identity provider
+func (db *appdbimpl) GetUserIDByIdentity(issuer, subject string) (string, error) {
+	var id string
+	err := db.c.QueryRow(`SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?`,
+		issuer, subject).Scan(&id)
+	return id, err // può essere sql.ErrNoRows
+}
+
+// CreateUserWithIdentity creates a new user linked to the subject of an external identity provider. It returns
+// ErrUsernameTaken if another user has the username.
+func (db *appdbimpl) CreateUserWithIdentity(id, username, issuer, subject string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(`INSERT INTO users (id, username) VALUES (?, ?)`, id, username); err != nil {
+		// l'unico vincolo UNIQUE di users è sul nome
+		var se sqlite3.Error
+		if errors.As(err, &se) && se.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return ErrUsernameTaken
+		}
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO user_identities (issuer, subject, user_id) VALUES (?, ?, ?)`,
+		issuer, subject, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HasIdentity reports whether the user is linked to an external identity provider
+func (db *appdbimpl) HasIdentity(userID string) (bool, error) {
+	var one int
+	err := db.c.QueryRow(`SELECT 1 FROM user_identities WHERE user_id = ? LIMIT 1`, userID).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Mention is a member of the conversation mentioned in a message. Offset and Length locate the "@username" token in
+// the text, in UTF-16 code units. The token keeps the name used when the message was sent, while UserID follows the
+// user through renames.
+type Mention struct {
+	UserID string
+	Offset int
+	Length int
+}
+
+// UserMention is a message that mentions the user
+type UserMention struct {
+	MessageID        int
+	ConversationID   int
+	ConversationName string
+	Read             bool
+}
+
+// insertMentions stores the mentions of the message, replacing the previous ones
+func insertMentions(tx *sql.Tx, messageID int, mentions []Mention) error {
+	if _, err := tx.Exec(`DELETE FROM message_mentions WHERE message_id = ?`, messageID); err != nil {
+		return err
+	}
+	for _, m := range mentions {
+		_, err := tx.Exec(`
+			INSERT INTO message_mentions (message_id, user_id, utf16_offset, utf16_length)
+			VALUES (?, ?, ?, ?)`, messageID, m.UserID, m.Offset, m.Length)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListConversationMentions returns the mentions in the messages of the conversation, by message ID, in the order they
+// appear in the text
+func (db *appdbimpl) ListConversationMentions(conversationID int) (map[int][]Mention, error) {
+	rows, err := db.c.Query(`
+		SELECT mm.message_id, mm.user_id, mm.utf16_offset, mm.utf16_length
+		FROM message_mentions mm
+		JOIN messages m ON m.id = mm.message_id
+		WHERE m.conversation_id = ?
+		ORDER BY mm.message_id, mm.utf16_offset`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int][]Mention)
+	for rows.Next() {
+		var id int
+		var m Mention
+		if err := rows.Scan(&id, &m.UserID, &m.Offset, &m.Length); err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], m)
+	}
+	return out, rows.Err()
+}
+
+// ListMentions returns up to limit messages that mention the user, newest first, starting before the message beforeID
+// (0 = from the newest). Only the conversations the user is still a member of are considered, and deleted, hidden and
+// expired messages are skipped.
+func (db *appdbimpl) ListMentions(userID string, beforeID, limit int, now time.Time) ([]UserMention, error) {
+	rows, err := db.c.Query(`
+		SELECT m.id, m.conversation_id,
+		CASE
+			WHEN c.is_group = 1 OR TRIM(IFNULL(c.name,'')) <> '' THEN c.name
+			ELSE (
+			SELECT u.username
+			FROM user_conversations uc2
+			JOIN users u ON u.id = uc2.user_id
+			WHERE uc2.conversation_id = c.id AND uc2.user_id <> uc.user_id
+			LIMIT 1
+			)
+		END,
+		EXISTS (SELECT 1 FROM message_receipts r WHERE r.message_id = m.id AND r.user_id = uc.user_id AND r.read_at IS NOT NULL)
+		FROM messages m
+		JOIN conversations c ON c.id = m.conversation_id
+		JOIN user_conversations uc ON uc.conversation_id = m.conversation_id AND uc.user_id = ?
+		WHERE m.id IN (SELECT message_id FROM message_mentions WHERE user_id = uc.user_id)
+		  AND (? = 0 OR m.id < ?)
+		  AND m.deleted_at IS NULL
+		  AND m.id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = uc.user_id)
+		  AND (m.expires_at IS NULL OR m.expires_at > ?)
+		ORDER BY m.id DESC
+		LIMIT ?`, userID, beforeID, beforeID, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []UserMention
+	for rows.Next() {
+		var m UserMention
+		var name *string
+		if err := rows.Scan(&m.MessageID, &m.ConversationID, &name, &m.Read); err != nil {
+			return nil, err
+		}
+		if name != nil {
+			m.ConversationName = *name
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
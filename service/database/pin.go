@@ -0,0 +1,88 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTooManyPins is returned by PinMessage when the conversation already has the maximum number of pinned messages
+var ErrTooManyPins = errors.New("too many pinned messages")
+
+// Pin is a message pinned in its conversation
+type Pin struct {
+	MessageID int
+	PinnedBy  string
+	PinnedAt  time.Time
+}
+
+// PinMessage pins the message in its conversation, if it has less than limit pins. It returns false if the message was
+// already pinned.
+func (db *appdbimpl) PinMessage(conversationID, messageID int, userID string, at time.Time, limit int) (bool, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var pinned, count int
+	err = tx.QueryRow(`
+		SELECT COALESCE(SUM(message_id = ?), 0), COUNT(*)
+		FROM message_pins
+		WHERE conversation_id = ?`, messageID, conversationID).Scan(&pinned, &count)
+	if err != nil {
+		return false, err
+	}
+	if pinned > 0 {
+		return false, nil
+	}
+	if count >= limit {
+		return false, ErrTooManyPins
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO message_pins (conversation_id, message_id, pinned_by, pinned_at)
+		VALUES (?, ?, ?, ?)`, conversationID, messageID, userID, at)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// UnpinMessage removes the pin of the message. It returns false if the message was not pinned in the conversation.
+func (db *appdbimpl) UnpinMessage(conversationID, messageID int) (bool, error) {
+	res, err := db.c.Exec(`DELETE FROM message_pins WHERE conversation_id = ? AND message_id = ?`,
+		conversationID, messageID)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
+
+// ListPins returns the pins of the conversation, latest first, skipping the expired messages
+func (db *appdbimpl) ListPins(conversationID int, now time.Time) ([]Pin, error) {
+	rows, err := db.c.Query(`
+		SELECT p.message_id, p.pinned_by, p.pinned_at
+		FROM message_pins p
+		JOIN messages m ON m.id = p.message_id
+		WHERE p.conversation_id = ? AND m.deleted_at IS NULL
+		  AND (m.expires_at IS NULL OR m.expires_at > ?)
+		ORDER BY p.pinned_at DESC, p.message_id DESC`, conversationID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Pin
+	for rows.Next() {
+		var p Pin
+		if err := rows.Scan(&p.MessageID, &p.PinnedBy, &p.PinnedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,264 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// NewPoll is a poll to create with its message
+type NewPoll struct {
+	Question       string
+	Options        []string
+	MultipleChoice bool
+	Anonymous      bool
+	// ClosesAt is the time the poll closes by itself, if any
+	ClosesAt *time.Time
+}
+
+// Poll is a poll, with its options and votes
+type Poll struct {
+	ID             int
+	MessageID      int
+	ConversationID int
+	CreatorID      string
+	Question       string
+	MultipleChoice bool
+	Anonymous      bool
+	ClosesAt       *time.Time
+	ClosedAt       *time.Time
+	CreatedAt      time.Time
+	Options        []PollOption
+}
+
+// PollOption is an option of a poll, with the users that voted it, earliest first
+type PollOption struct {
+	Text   string
+	Voters []string
+}
+
+// Closed reports whether the poll is closed at the given time, by its creator or because its close time passed
+func (p *Poll) Closed(at time.Time) bool {
+	return p.ClosedAt != nil || p.ClosesAt != nil && !p.ClosesAt.After(at)
+}
+
+// CreatePoll stores the message of the poll and the poll itself, created at the given time. It returns the ID of the
+// poll and of the message.
+func (db *appdbimpl) CreatePoll(msg NewMessage, p NewPoll, at time.Time) (int, int, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	messageID, err := insertMessage(tx, msg, at)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var pollID int
+	err = tx.QueryRow(`
+		INSERT INTO polls (message_id, conversation_id, creator_id, question, multiple_choice, anonymous, closes_at,
+		                   created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+		messageID, msg.ConversationID, msg.SenderID, p.Question, p.MultipleChoice, p.Anonymous, p.ClosesAt,
+		at).Scan(&pollID)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i, o := range p.Options {
+		_, err = tx.Exec(`INSERT INTO poll_options (poll_id, position, text) VALUES (?, ?, ?)`, pollID, i, o)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return pollID, messageID, tx.Commit()
+}
+
+// GetPoll returns the poll, or sql.ErrNoRows if it doesn't exist
+func (db *appdbimpl) GetPoll(id int) (*Poll, error) {
+	return db.getPoll(`WHERE id = ?`, id)
+}
+
+// GetPollByMessage returns the poll of the message, or sql.ErrNoRows if the message is not a poll
+func (db *appdbimpl) GetPollByMessage(messageID int) (*Poll, error) {
+	return db.getPoll(`WHERE message_id = ?`, messageID)
+}
+
+const pollColumns = `id, message_id, conversation_id, creator_id, question, multiple_choice, anonymous, closes_at,
+	closed_at, created_at`
+
+func scanPoll(row scanner) (*Poll, error) {
+	var p Poll
+	var closesAt, closedAt sql.NullTime
+	err := row.Scan(&p.ID, &p.MessageID, &p.ConversationID, &p.CreatorID, &p.Question, &p.MultipleChoice,
+		&p.Anonymous, &closesAt, &closedAt, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if closesAt.Valid {
+		p.ClosesAt = &closesAt.Time
+	}
+	if closedAt.Valid {
+		p.ClosedAt = &closedAt.Time
+	}
+	return &p, nil
+}
+
+func (db *appdbimpl) getPoll(where string, arg int) (*Poll, error) {
+	p, err := scanPoll(db.c.QueryRow(`SELECT `+pollColumns+` FROM polls `+where, arg))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.c.Query(`SELECT text FROM poll_options WHERE poll_id = ? ORDER BY position`, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o PollOption
+		if err := rows.Scan(&o.Text); err != nil {
+			return nil, err
+		}
+		p.Options = append(p.Options, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	votes, err := db.c.Query(`
+		SELECT position, user_id FROM poll_votes WHERE poll_id = ? ORDER BY voted_at, user_id`, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer votes.Close()
+	for votes.Next() {
+		var pos int
+		var uid string
+		if err := votes.Scan(&pos, &uid); err != nil {
+			return nil, err
+		}
+		if pos >= 0 && pos < len(p.Options) {
+			p.Options[pos].Voters = append(p.Options[pos].Voters, uid)
+		}
+	}
+	return p, votes.Err()
+}
+
+// ListConversationPolls returns the polls of the conversation, with their options and votes, by message ID
+func (db *appdbimpl) ListConversationPolls(conversationID int) (map[int]*Poll, error) {
+	rows, err := db.c.Query(`SELECT `+pollColumns+` FROM polls WHERE conversation_id = ?`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int]*Poll)
+	byID := make(map[int]*Poll)
+	for rows.Next() {
+		p, err := scanPoll(rows)
+		if err != nil {
+			return nil, err
+		}
+		out[p.MessageID] = p
+		byID[p.ID] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(byID) == 0 {
+		return out, nil
+	}
+
+	options, err := db.c.Query(`
+		SELECT o.poll_id, o.text
+		FROM poll_options o
+		JOIN polls p ON p.id = o.poll_id
+		WHERE p.conversation_id = ?
+		ORDER BY o.poll_id, o.position`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer options.Close()
+	for options.Next() {
+		var id int
+		var o PollOption
+		if err := options.Scan(&id, &o.Text); err != nil {
+			return nil, err
+		}
+		if p, ok := byID[id]; ok {
+			p.Options = append(p.Options, o)
+		}
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+
+	votes, err := db.c.Query(`
+		SELECT v.poll_id, v.position, v.user_id
+		FROM poll_votes v
+		JOIN polls p ON p.id = v.poll_id
+		WHERE p.conversation_id = ?
+		ORDER BY v.voted_at, v.user_id`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer votes.Close()
+	for votes.Next() {
+		var id, pos int
+		var uid string
+		if err := votes.Scan(&id, &pos, &uid); err != nil {
+			return nil, err
+		}
+		if p, ok := byID[id]; ok && pos >= 0 && pos < len(p.Options) {
+			p.Options[pos].Voters = append(p.Options[pos].Voters, uid)
+		}
+	}
+	return out, votes.Err()
+}
+
+// SetPollVotes replaces the votes of the user in the poll with the given options (none to retract the vote). It
+// returns false if the poll is closed at the given time.
+func (db *appdbimpl) SetPollVotes(pollID int, userID string, options []int, at time.Time) (bool, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// il controllo sulla chiusura è nella stessa transazione dei voti
+	var open bool
+	err = tx.QueryRow(`
+		SELECT closed_at IS NULL AND (closes_at IS NULL OR closes_at > ?)
+		FROM polls WHERE id = ?`, at, pollID).Scan(&open)
+	if err != nil || !open {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ?`, pollID, userID); err != nil {
+		return false, err
+	}
+	for _, o := range options {
+		_, err = tx.Exec(`INSERT INTO poll_votes (poll_id, position, user_id, voted_at) VALUES (?, ?, ?, ?)`,
+			pollID, o, userID, at)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// ClosePoll closes the poll at the given time. It returns false if the poll was already closed.
+func (db *appdbimpl) ClosePoll(id int, at time.Time) (bool, error) {
+	res, err := db.c.Exec(`
+		UPDATE polls SET closed_at = ?
+		WHERE id = ? AND closed_at IS NULL AND (closes_at IS NULL OR closes_at > ?)`, at, id, at)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// LinkPreview is the cached preview of a link. OK is false when the preview could not be fetched: the link is tried
+// again later (see ListPendingLinks).
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+	SiteName    string
+	OK          bool
+	FetchedAt   time.Time
+}
+
+// insertLinks stores the links of the message, replacing the previous ones
+func insertLinks(tx *sql.Tx, messageID int, links []string) error {
+	if _, err := tx.Exec(`DELETE FROM message_links WHERE message_id = ?`, messageID); err != nil {
+		return err
+	}
+	for i, u := range links {
+		_, err := tx.Exec(`INSERT INTO message_links (message_id, position, url) VALUES (?, ?, ?)`, messageID, i, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListPendingLinks returns up to limit links of messages that have no preview yet, or whose fetch failed before
+// retryBefore
+func (db *appdbimpl) ListPendingLinks(retryBefore time.Time, limit int) ([]string, error) {
+	rows, err := db.c.Query(`
+		SELECT DISTINCT l.url
+		FROM message_links l
+		LEFT JOIN link_previews p ON p.url = l.url
+		WHERE p.url IS NULL OR (p.ok = 0 AND p.fetched_at < ?)
+		LIMIT ?`, retryBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// SaveLinkPreview stores the preview of a link in the cache, replacing the previous one
+func (db *appdbimpl) SaveLinkPreview(p LinkPreview) error {
+	_, err := db.c.Exec(`
+		INSERT INTO link_previews (url, title, description, image_url, site_name, ok, fetched_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (url) DO UPDATE SET
+			title = excluded.title, description = excluded.description, image_url = excluded.image_url,
+			site_name = excluded.site_name, ok = excluded.ok, fetched_at = excluded.fetched_at`,
+		p.URL, p.Title, p.Description, p.ImageURL, p.SiteName, p.OK, p.FetchedAt)
+	return err
+}
+
+// ListConversationPreviews returns the previews of the links of the messages of the conversation that were fetched
+// successfully, by message ID, in the order the links appear in the text
+func (db *appdbimpl) ListConversationPreviews(conversationID int) (map[int][]LinkPreview, error) {
+	rows, err := db.c.Query(`
+		SELECT l.message_id, p.url, p.title, p.description, p.image_url, p.site_name, p.ok, p.fetched_at
+		FROM message_links l
+		JOIN messages m ON m.id = l.message_id
+		JOIN link_previews p ON p.url = l.url
+		WHERE m.conversation_id = ? AND p.ok = 1
+		ORDER BY l.message_id, l.position`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int][]LinkPreview)
+	for rows.Next() {
+		var id int
+		var p LinkPreview
+		err := rows.Scan(&id, &p.URL, &p.Title, &p.Description, &p.ImageURL, &p.SiteName, &p.OK, &p.FetchedAt)
+		if err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], p)
+	}
+	return out, rows.Err()
+}
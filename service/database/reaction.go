@@ -0,0 +1,182 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"wasa-project/service/emoji"
+	"wasa-project/service/globaltime"
+)
+
+// Reaction is an emoji added by a user to a message
+type Reaction struct {
+	MessageID int
+	UserID    string
+	Emoji     string
+	CreatedAt time.Time
+}
+
+// migrateComments moves the rows of the old message_comments table (one comment per user and message) to
+// message_reactions. Comments were free text: the ones that are not a single emoji can't become reactions, so they are
+// kept in the table, renamed to message_comments_legacy.
+func migrateComments(db *sql.DB) error {
+	var tableName string
+	err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='message_comments';`).Scan(&tableName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(`SELECT id, message_id, user_id, comment, timestamp FROM message_comments`)
+	if err != nil {
+		return err
+	}
+	var reactions []Reaction
+	var migrated []int
+	kept := 0
+	for rows.Next() {
+		var r Reaction
+		var id int
+		var at sql.NullTime
+		if err := rows.Scan(&id, &r.MessageID, &r.UserID, &r.Emoji, &at); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		r.CreatedAt = globaltime.Now().UTC()
+		if at.Valid {
+			r.CreatedAt = at.Time
+		}
+		r.Emoji = strings.TrimSpace(r.Emoji)
+		if !emoji.IsSingle(r.Emoji) {
+			kept++
+			continue
+		}
+		reactions = append(reactions, r)
+		migrated = append(migrated, id)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range reactions {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO message_reactions (message_id, user_id, emoji, created_at)
+			VALUES (?, ?, ?, ?)`, r.MessageID, r.UserID, r.Emoji, r.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	// nella tabella vecchia restano solo i commenti che non sono diventati reazioni
+	for _, id := range migrated {
+		if _, err := tx.Exec(`DELETE FROM message_comments WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`ALTER TABLE message_comments RENAME TO message_comments_legacy`); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if kept > 0 {
+		log.Printf("migrateComments: %d comments that are not a single emoji kept in message_comments_legacy", kept)
+	}
+	return nil
+}
+
+// AddReaction adds the emoji to the reactions of the user. It returns false if the user already reacted with it.
+func (db *appdbimpl) AddReaction(messageID int, userID, emoji string, at time.Time) (bool, error) {
+	res, err := db.c.Exec(`
+		INSERT OR IGNORE INTO message_reactions (message_id, user_id, emoji, created_at)
+		VALUES (?, ?, ?, ?)`, messageID, userID, emoji, at)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
+
+// SetReaction replaces all the reactions of the user to the message with the given emoji, and returns the ID of the
+// reaction. It backs the old single-comment endpoints.
+func (db *appdbimpl) SetReaction(messageID int, userID, emoji string, at time.Time) (int, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(`DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji <> ?`,
+		messageID, userID, emoji)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO message_reactions (message_id, user_id, emoji, created_at)
+		VALUES (?, ?, ?, ?)`, messageID, userID, emoji, at)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.QueryRow(`SELECT id FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`,
+		messageID, userID, emoji).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// RemoveReaction removes the emoji from the reactions of the user. An empty emoji removes all of them.
+func (db *appdbimpl) RemoveReaction(messageID int, userID, emoji string) (bool, error) {
+	res, err := db.c.Exec(`
+		DELETE FROM message_reactions
+		WHERE message_id = ? AND user_id = ? AND (? = '' OR emoji = ?)`,
+		messageID, userID, emoji, emoji)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
+
+// ListConversationReactions returns the reactions to the messages of the conversation, by message ID, oldest first
+func (db *appdbimpl) ListConversationReactions(conversationID int) (map[int][]Reaction, error) {
+	rows, err := db.c.Query(`
+		SELECT r.message_id, r.user_id, r.emoji, r.created_at
+		FROM message_reactions r
+		JOIN messages m ON m.id = r.message_id
+		WHERE m.conversation_id = ?
+		ORDER BY r.created_at ASC, r.id ASC`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int][]Reaction)
+	for rows.Next() {
+		var r Reaction
+		if err := rows.Scan(&r.MessageID, &r.UserID, &r.Emoji, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		out[r.MessageID] = append(out[r.MessageID], r)
+	}
+	return out, rows.Err()
+}
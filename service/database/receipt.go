@@ -0,0 +1,98 @@
+package database
+
+import "time"
+
+// ReceiptSummary aggregates the receipts of a message over the current members of its conversation, the sender
+// excluded
+type ReceiptSummary struct {
+	Recipients int
+	Delivered  int
+	Read       int
+}
+
+// Message statuses, as shown to clients
+const (
+	MessageStatusSent      = "sent"
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+)
+
+// Status returns the aggregated status: a message is delivered (or read) only when all the recipients got (or read)
+// it
+func (s ReceiptSummary) Status() string {
+	switch {
+	case s.Recipients == 0:
+		return MessageStatusSent
+	case s.Read >= s.Recipients:
+		return MessageStatusRead
+	case s.Delivered >= s.Recipients:
+		return MessageStatusDelivered
+	default:
+		return MessageStatusSent
+	}
+}
+
+// MarkDelivered marks as delivered to the user all the messages of the conversation sent by the others. A conversation
+// ID of 0 means all the conversations of the user. Receipts always cover all the messages up to the last one, so only
+// the messages after the last receipt of the user in each conversation are considered.
+func (db *appdbimpl) MarkDelivered(userID string, conversationID int, at time.Time) error {
+	_, err := db.c.Exec(`
+		INSERT INTO message_receipts (message_id, user_id, delivered_at)
+		SELECT m.id, uc.user_id, ?
+		FROM user_conversations uc
+		JOIN messages m ON m.conversation_id = uc.conversation_id AND m.id > COALESCE((
+			SELECT rm.id
+			FROM messages rm
+			JOIN message_receipts r ON r.message_id = rm.id AND r.user_id = uc.user_id
+			WHERE rm.conversation_id = uc.conversation_id
+			ORDER BY rm.id DESC
+			LIMIT 1), 0)
+		WHERE uc.user_id = ? AND (? = 0 OR uc.conversation_id = ?) AND m.sender_id <> uc.user_id
+		ON CONFLICT (message_id, user_id) DO NOTHING`,
+		at, userID, conversationID, conversationID)
+	return err
+}
+
+// MarkRead marks as read (and delivered, if needed) the messages of the conversation sent by the others, up to
+// messageID included
+func (db *appdbimpl) MarkRead(userID string, conversationID, messageID int, at time.Time) error {
+	_, err := db.c.Exec(`
+		INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at)
+		SELECT m.id, ?, ?, ?
+		FROM messages m
+		WHERE m.conversation_id = ? AND m.id <= ? AND m.sender_id <> ?
+		ON CONFLICT (message_id, user_id) DO UPDATE
+			SET delivered_at = COALESCE(delivered_at, excluded.delivered_at),
+			    read_at      = COALESCE(read_at, excluded.read_at)`,
+		userID, at, at, conversationID, messageID, userID)
+	return err
+}
+
+// GetReceiptSummaries returns the receipt summary of every message of the conversation, by message ID
+func (db *appdbimpl) GetReceiptSummaries(conversationID int) (map[int]ReceiptSummary, error) {
+	rows, err := db.c.Query(`
+		SELECT m.id,
+		       COUNT(uc.user_id),
+		       COUNT(r.delivered_at),
+		       COUNT(r.read_at)
+		FROM messages m
+		LEFT JOIN user_conversations uc ON uc.conversation_id = m.conversation_id AND uc.user_id <> m.sender_id
+		LEFT JOIN message_receipts r ON r.message_id = m.id AND r.user_id = uc.user_id
+		WHERE m.conversation_id = ?
+		GROUP BY m.id`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int]ReceiptSummary{}
+	for rows.Next() {
+		var id int
+		var s ReceiptSummary
+		if err := rows.Scan(&id, &s.Recipients, &s.Delivered, &s.Read); err != nil {
+			return nil, err
+		}
+		out[id] = s
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ScheduledMessage is a message waiting to be sent at ScheduledAt
+type ScheduledMessage struct {
+	ID int
+	NewMessage
+	ScheduledAt time.Time
+	CreatedAt   time.Time
+	// Attempts is the number of failed attempts to send it
+	Attempts int
+}
+
+const scheduledColumns = `id, conversation_id, sender_id, text, photo, reply_to_id, scheduled_at, created_at, attempts`
+
+func scanScheduled(row scanner) (ScheduledMessage, error) {
+	var s ScheduledMessage
+	err := row.Scan(&s.ID, &s.ConversationID, &s.SenderID, &s.Text, &s.Photo, &s.ReplyToID, &s.ScheduledAt,
+		&s.CreatedAt, &s.Attempts)
+	return s, err
+}
+
+// CreateScheduledMessage stores a message to be sent later and returns its ID
+func (db *appdbimpl) CreateScheduledMessage(s ScheduledMessage) (int, error) {
+	res, err := db.c.Exec(`
+		INSERT INTO scheduled_messages (conversation_id, sender_id, text, photo, reply_to_id, scheduled_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		s.ConversationID, s.SenderID, s.Text, s.Photo, s.ReplyToID, s.ScheduledAt, s.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// ListScheduledMessages returns the pending messages of the sender, the first to be sent first
+func (db *appdbimpl) ListScheduledMessages(senderID string) ([]ScheduledMessage, error) {
+	rows, err := db.c.Query(`
+		SELECT `+scheduledColumns+`
+		FROM scheduled_messages
+		WHERE sender_id = ?
+		ORDER BY scheduled_at, id`, senderID)
+	if err != nil {
+		return nil, err
+	}
+	return collectScheduled(rows)
+}
+
+// ListDueScheduledMessages returns up to limit messages whose time has come, oldest first. The messages that already
+// failed maxAttempts times are skipped.
+func (db *appdbimpl) ListDueScheduledMessages(now time.Time, maxAttempts, limit int) ([]ScheduledMessage, error) {
+	rows, err := db.c.Query(`
+		SELECT `+scheduledColumns+`
+		FROM scheduled_messages
+		WHERE scheduled_at <= ? AND attempts < ?
+		ORDER BY scheduled_at, id
+		LIMIT ?`, now, maxAttempts, limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectScheduled(rows)
+}
+
+// TakeScheduledMessage removes the scheduled message and returns it, so that it's sent only once. It returns
+// sql.ErrNoRows if the message was cancelled in the meantime.
+func (db *appdbimpl) TakeScheduledMessage(id int) (*ScheduledMessage, error) {
+	s, err := scanScheduled(db.c.QueryRow(`
+		DELETE FROM scheduled_messages
+		WHERE id = ?
+		RETURNING `+scheduledColumns, id))
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SendScheduledMessage removes the scheduled message and stores it as sent at the given time, in one transaction: if
+// the message can't be stored, it stays scheduled with the same ID. It returns the ID of the new message, or
+// sql.ErrNoRows if the scheduled message was cancelled in the meantime.
+func (db *appdbimpl) SendScheduledMessage(id int, m NewMessage, at time.Time) (int, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`DELETE FROM scheduled_messages WHERE id = ?`, id)
+	if err != nil {
+		return 0, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if aff == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	msgID, err := insertMessage(tx, m, at)
+	if err != nil {
+		return 0, err
+	}
+	return msgID, tx.Commit()
+}
+
+// RecordScheduledFailure counts a failed attempt to send the scheduled message
+func (db *appdbimpl) RecordScheduledFailure(id int) error {
+	_, err := db.c.Exec(`UPDATE scheduled_messages SET attempts = attempts + 1 WHERE id = ?`, id)
+	return err
+}
+
+// CancelScheduledMessage removes a pending message of the sender and returns it. It returns sql.ErrNoRows if there is
+// no such message.
+func (db *appdbimpl) CancelScheduledMessage(id int, senderID string) (*ScheduledMessage, error) {
+	s, err := scanScheduled(db.c.QueryRow(`
+		DELETE FROM scheduled_messages
+		WHERE id = ? AND sender_id = ?
+		RETURNING `+scheduledColumns, id, senderID))
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func collectScheduled(rows *sql.Rows) ([]ScheduledMessage, error) {
+	defer rows.Close()
+
+	out := []ScheduledMessage{}
+	for rows.Next() {
+		s, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
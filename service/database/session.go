@@ -0,0 +1,92 @@
+package database
+
+import "time"
+
+type Session struct {
+	ID         string
+	UserID     string
+	Device     string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+func (db *appdbimpl) CreateSession(s Session) error {
+	_, err := db.c.Exec(`
+		INSERT INTO sessions (id, user_id, device, ip, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.UserID, s.Device, s.IP, s.CreatedAt, s.LastSeenAt, s.ExpiresAt)
+	return err
+}
+
+func (db *appdbimpl) GetSession(id string) (*Session, error) {
+	row := db.c.QueryRow(`
+		SELECT id, user_id, device, ip, created_at, last_seen_at, expires_at, revoked_at
+		FROM sessions
+		WHERE id = ?`, id)
+	var s Session
+	if err := row.Scan(&s.ID, &s.UserID, &s.Device, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.RevokedAt); err != nil {
+		return nil, err // può essere sql.ErrNoRows
+	}
+	return &s, nil
+}
+
+func (db *appdbimpl) TouchSession(id string, lastSeen time.Time) error {
+	_, err := db.c.Exec(`UPDATE sessions SET last_seen_at = ? WHERE id = ?`, lastSeen, id)
+	return err
+}
+
+// ListActiveSessions returns the sessions of the user that are neither revoked nor expired, most recent first
+func (db *appdbimpl) ListActiveSessions(userID string, now time.Time) ([]Session, error) {
+	rows, err := db.c.Query(`
+		SELECT id, user_id, device, ip, created_at, last_seen_at, expires_at, revoked_at
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_seen_at DESC`, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Device, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.RevokedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// RevokeSession marks the session as revoked. It returns false if the session does not exist, it belongs to another
+// user, or it was already revoked.
+func (db *appdbimpl) RevokeSession(id, userID string, at time.Time) (bool, error) {
+	res, err := db.c.Exec(`
+		UPDATE sessions SET revoked_at = ?
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		at, id, userID)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
+
+// RevokeOtherSessions revokes all the sessions of the user except keepID, and returns how many were revoked
+func (db *appdbimpl) RevokeOtherSessions(userID, keepID string, at time.Time) (int, error) {
+	res, err := db.c.Exec(`
+		UPDATE sessions SET revoked_at = ?
+		WHERE user_id = ? AND id != ? AND revoked_at IS NULL`,
+		at, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+	aff, err := res.RowsAffected()
+	return int(aff), err
+}
@@ -0,0 +1,108 @@
+package database
+
+import "time"
+
+// Star is a message bookmarked by a user, with the name of its conversation as the user sees it
+type Star struct {
+	ID               int
+	MessageID        int
+	ConversationID   int
+	ConversationName string
+	StarredAt        time.Time
+}
+
+// StarMessage adds the message to the starred messages of the user. It returns false if it was already starred.
+func (db *appdbimpl) StarMessage(messageID int, userID string, at time.Time) (bool, error) {
+	res, err := db.c.Exec(`
+		INSERT OR IGNORE INTO message_stars (user_id, message_id, starred_at)
+		VALUES (?, ?, ?)`, userID, messageID, at)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
+
+// UnstarMessage removes the star of the user from the message. It returns false if the message was not starred.
+func (db *appdbimpl) UnstarMessage(messageID int, userID string) (bool, error) {
+	res, err := db.c.Exec(`DELETE FROM message_stars WHERE user_id = ? AND message_id = ?`, userID, messageID)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return aff > 0, nil
+}
+
+// ListStars returns up to limit stars of the user, latest first, starting after the star beforeID (0 = from the
+// latest). Deleted, hidden and expired messages are skipped; the membership of the user is not checked here.
+func (db *appdbimpl) ListStars(userID string, beforeID, limit int, now time.Time) ([]Star, error) {
+	rows, err := db.c.Query(`
+		SELECT s.id, s.message_id, m.conversation_id,
+		CASE
+			WHEN c.is_group = 1 OR TRIM(IFNULL(c.name,'')) <> '' THEN c.name
+			ELSE (
+			SELECT u.username
+			FROM user_conversations uc
+			JOIN users u ON u.id = uc.user_id
+			WHERE uc.conversation_id = c.id AND uc.user_id <> s.user_id
+			LIMIT 1
+			)
+		END,
+		s.starred_at
+		FROM message_stars s
+		JOIN messages m ON m.id = s.message_id
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE s.user_id = ? AND (? = 0 OR s.id < ?)
+		  AND m.deleted_at IS NULL
+		  AND m.id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = s.user_id)
+		  AND (m.expires_at IS NULL OR m.expires_at > ?)
+		ORDER BY s.id DESC
+		LIMIT ?`, userID, beforeID, beforeID, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Star
+	for rows.Next() {
+		var s Star
+		var name *string
+		if err := rows.Scan(&s.ID, &s.MessageID, &s.ConversationID, &name, &s.StarredAt); err != nil {
+			return nil, err
+		}
+		if name != nil {
+			s.ConversationName = *name
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// GetStarredMessageIDs returns the set of the messages of the conversation starred by the user
+func (db *appdbimpl) GetStarredMessageIDs(conversationID int, userID string) (map[int]bool, error) {
+	rows, err := db.c.Query(`
+		SELECT s.message_id
+		FROM message_stars s
+		JOIN messages m ON m.id = s.message_id
+		WHERE s.user_id = ? AND m.conversation_id = ?`, userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out[id] = true
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,66 @@
+package database
+
+import "time"
+
+// ThreadSummary describes the replies of a thread
+type ThreadSummary struct {
+	ReplyCount  int
+	LastReplyAt time.Time
+}
+
+// ListThreadReplies returns up to limit replies of the thread, oldest first, starting after the reply afterID (0 to
+// start from the beginning). The replies the user deleted for themselves and the expired ones are skipped.
+func (db *appdbimpl) ListThreadReplies(rootID int, userID string, afterID, limit int, now time.Time) ([]Message, error) {
+	rows, err := db.c.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE thread_root_id = ? AND id > ?
+		  AND id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = ?)
+		  AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY id ASC
+		LIMIT ?`, rootID, afterID, userID, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// GetThreadSummaries returns the summary of the threads of the conversation, by root message ID. Messages without
+// replies are not in the map.
+func (db *appdbimpl) GetThreadSummaries(conversationID int, now time.Time) (map[int]ThreadSummary, error) {
+	rows, err := db.c.Query(`
+		SELECT thread_root_id, COUNT(*), strftime('%Y-%m-%dT%H:%M:%SZ', MAX(timestamp))
+		FROM messages
+		WHERE conversation_id = ? AND thread_root_id IS NOT NULL
+		  AND (expires_at IS NULL OR expires_at > ?)
+		GROUP BY thread_root_id`, conversationID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int]ThreadSummary)
+	for rows.Next() {
+		var id int
+		var s ThreadSummary
+		var last string
+		if err := rows.Scan(&id, &s.ReplyCount, &last); err != nil {
+			return nil, err
+		}
+		if s.LastReplyAt, err = time.Parse(time.RFC3339, last); err != nil {
+			return nil, err
+		}
+		out[id] = s
+	}
+	return out, rows.Err()
+}
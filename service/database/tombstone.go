@@ -0,0 +1,78 @@
+package database
+
+import "time"
+
+// HideMessage deletes the message only for the user
+func (db *appdbimpl) HideMessage(messageID int, userID string, at time.Time) error {
+	_, err := db.c.Exec(`
+		INSERT OR IGNORE INTO message_hidden (message_id, user_id, hidden_at)
+		VALUES (?, ?, ?)`, messageID, userID, at)
+	return err
+}
+
+// PurgeDeletedMessages removes the photos of the messages deleted before the given time (the rest of the contents is
+// removed by DeleteMessage), and whatever else is left of them from before. The tombstones themselves stay. It returns
+// the URLs of the photos that are not used by any message anymore, so that their files can be removed.
+func (db *appdbimpl) PurgeDeletedMessages(before time.Time) ([]string, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// le foto possono essere condivise con i messaggi inoltrati
+	rows, err := tx.Query(`
+		SELECT DISTINCT photo
+		FROM messages
+		WHERE deleted_at IS NOT NULL AND deleted_at <= ? AND photo IS NOT NULL`, before)
+	if err != nil {
+		return nil, err
+	}
+	var photos []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		photos = append(photos, p)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, q := range []string{
+		`DELETE FROM message_edits WHERE message_id IN (
+			SELECT id FROM messages WHERE deleted_at IS NOT NULL AND deleted_at <= ?)`,
+		`DELETE FROM message_reactions WHERE message_id IN (
+			SELECT id FROM messages WHERE deleted_at IS NOT NULL AND deleted_at <= ?)`,
+		`DELETE FROM message_entities WHERE message_id IN (
+			SELECT id FROM messages WHERE deleted_at IS NOT NULL AND deleted_at <= ?)`,
+		`DELETE FROM message_mentions WHERE message_id IN (
+			SELECT id FROM messages WHERE deleted_at IS NOT NULL AND deleted_at <= ?)`,
+		`DELETE FROM message_links WHERE message_id IN (
+			SELECT id FROM messages WHERE deleted_at IS NOT NULL AND deleted_at <= ?)`,
+		`DELETE FROM polls WHERE message_id IN (
+			SELECT id FROM messages WHERE deleted_at IS NOT NULL AND deleted_at <= ?)`,
+		`UPDATE messages SET text = '', photo = NULL
+			WHERE deleted_at IS NOT NULL AND deleted_at <= ? AND (text <> '' OR photo IS NOT NULL)`,
+	} {
+		if _, err := tx.Exec(q, before); err != nil {
+			return nil, err
+		}
+	}
+
+	var unused []string
+	for _, p := range photos {
+		var uses int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM messages WHERE photo = ?`, p).Scan(&uses)
+		if err != nil {
+			return nil, err
+		}
+		if uses == 0 {
+			unused = append(unused, p)
+		}
+	}
+	return unused, tx.Commit()
+}
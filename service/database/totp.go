@@ -0,0 +1,99 @@
+package database
+
+import "time"
+
+// TOTP is the second factor of a user. Secret is set (and Enabled false) while the setup waits for confirmation.
+// LastCounter is the time step of the last accepted code, so that codes can't be used twice.
+type TOTP struct {
+	Secret      *string
+	Enabled     bool
+	LastCounter int64
+}
+
+func (db *appdbimpl) GetTOTP(userID string) (*TOTP, error) {
+	row := db.c.QueryRow(`SELECT totp_secret, totp_enabled, totp_last_counter FROM users WHERE id = ?`, userID)
+	var t TOTP
+	if err := row.Scan(&t.Secret, &t.Enabled, &t.LastCounter); err != nil {
+		return nil, err // può essere sql.ErrNoRows
+	}
+	return &t, nil
+}
+
+// SetPendingTOTP stores a new secret, still to be confirmed
+func (db *appdbimpl) SetPendingTOTP(userID, secret string) error {
+	_, err := db.c.Exec(`
+		UPDATE users
+		SET totp_secret = ?, totp_enabled = 0, totp_last_counter = 0
+		WHERE id = ?`, secret, userID)
+	return err
+}
+
+// EnableTOTP enables the pending secret and replaces the recovery codes
+func (db *appdbimpl) EnableTOTP(userID string, counter int64, recoveryCodeHashes []string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled = 1, totp_last_counter = ? WHERE id = ?`, counter, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, h := range recoveryCodeHashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP removes the second factor and its recovery codes
+func (db *appdbimpl) DisableTOTP(userID string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled = 0, totp_last_counter = 0
+		WHERE id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPCounter records the time step of an accepted code. It returns false if a code of the same (or a later) time
+// step was already used: the check and the update are atomic, so two concurrent logins can't share a code.
+func (db *appdbimpl) UseTOTPCounter(userID string, counter int64) (bool, error) {
+	res, err := db.c.Exec(`
+		UPDATE users
+		SET totp_last_counter = ?
+		WHERE id = ? AND totp_last_counter < ?`, counter, userID, counter)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UseRecoveryCode marks the recovery code as used. It returns false if the code does not exist or was already used.
+func (db *appdbimpl) UseRecoveryCode(userID, codeHash string, at time.Time) (bool, error) {
+	res, err := db.c.Exec(`
+		UPDATE recovery_codes
+		SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`, at, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
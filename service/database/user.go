@@ -2,25 +2,72 @@ package database
 
 import "time"
 
+// User kinds
+const (
+	UserKindHuman = "human"
+	UserKindBot   = "bot"
+)
+
 type User struct {
 	ID       string
 	Username string
 	PhotoURL *string
+	Kind     string
+	OwnerID  *string // solo per i bot
 }
 
 type Message struct {
-	ID             int       `json:"id"`
-	ConversationID int       `json:"conversation_id"`
-	SenderID       string    `json:"sender_id"`
-	Text           string    `json:"text"`
-	Timestamp      time.Time `json:"timestamp"`
+	ID             int        `json:"id"`
+	ConversationID int        `json:"conversation_id"`
+	SenderID       string     `json:"sender_id"`
+	Text           string     `json:"text"`
+	Photo          *string    `json:"photo"`
+	ReplyToID      *int       `json:"reply_to_id"`
+	ThreadRootID   *int       `json:"thread_root_id"`
+	Timestamp      time.Time  `json:"timestamp"`
+	EditedAt       *time.Time `json:"edited_at"`
+
+	// provenance of forwarded messages, see NewMessage
+	ForwardedFromID   *int       `json:"forwarded_from_id"`
+	ForwardedSenderID *string    `json:"forwarded_sender_id"`
+	ForwardedAt       *time.Time `json:"forwarded_at"`
+	ForwardCount      int        `json:"forward_count"`
+
+	// DeletedAt is set on tombstones, the messages deleted for everyone
+	DeletedAt *time.Time `json:"deleted_at"`
+	// ExpiresAt is set on disappearing messages
+	ExpiresAt *time.Time `json:"expires_at"`
 }
 
-type Comment struct {
-	MessageID int
-	UserID    string
-	Comment   string
-	Timestamp time.Time
+// MessageEdit is a previous version of an edited message, replaced at ReplacedAt
+type MessageEdit struct {
+	Text       string
+	ReplacedAt time.Time
+}
+
+// NewMessage contains the data of a message to be inserted. Photo is the URL of the attached photo, if any: in that
+// case Text is the (optional) caption. ReplyToID is the quoted message, if any. ThreadRootID is set for thread
+// replies, which are not part of the main list of the conversation.
+//
+// Forwarded messages keep the ID, sender and time of the original message (the first of the chain, if a forward is
+// forwarded again) and the number of times it was forwarded so far.
+type NewMessage struct {
+	ConversationID int
+	SenderID       string
+	Text           string
+	Photo          *string
+	ReplyToID      *int
+	ThreadRootID   *int
+
+	ForwardedFromID   *int
+	ForwardedSenderID *string
+	ForwardedAt       *time.Time
+	ForwardCount      int
+
+	// Entities (the formatting of the text), Mentions and Links (the URLs to preview) are stored with the message
+	Entities []TextEntity
+	Mentions []Mention
+	Links    []string
 }
 
 type Conversation struct {
@@ -42,14 +89,17 @@ type ConversationSummary struct {
 	Photo     *string
 	IsGroup   bool
 	LastText  *string
+	LastPhoto bool // l'ultimo messaggio è una foto
 	LastAt    *time.Time
 	LastAtISO *string //mostra ultima attività in lista
+	Mentions  int     // menzioni non lette
+	Draft     *Draft  // bozza dell'utente, se c'è
 }
 
 func (db *appdbimpl) GetUserByID(id string) (*User, error) {
-	row := db.c.QueryRow("SELECT id, username, photo FROM users WHERE id = ?", id)
+	row := db.c.QueryRow("SELECT id, username, photo, kind, owner_id FROM users WHERE id = ?", id)
 	var u User
-	err := row.Scan(&u.ID, &u.Username, &u.PhotoURL)
+	err := row.Scan(&u.ID, &u.Username, &u.PhotoURL, &u.Kind, &u.OwnerID)
 	if err != nil {
 		return nil, err
 	}
@@ -59,9 +109,9 @@ func (db *appdbimpl) GetUserByID(id string) (*User, error) {
 //func CreateUser
 
 func (db *appdbimpl) GetUserByUsername(username string) (*User, error) {
-	row := db.c.QueryRow("SELECT id, username, photo FROM users WHERE username = ?", username)
+	row := db.c.QueryRow("SELECT id, username, photo, kind, owner_id FROM users WHERE username = ?", username)
 	var u User
-	err := row.Scan(&u.ID, &u.Username, &u.PhotoURL)
+	err := row.Scan(&u.ID, &u.Username, &u.PhotoURL, &u.Kind, &u.OwnerID)
 	if err != nil {
 		return nil, err
 	}
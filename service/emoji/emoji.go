@@ -0,0 +1,98 @@
+// Package emoji recognizes the strings that are a single emoji, as accepted for the reactions to messages
+package emoji
+
+import "unicode/utf8"
+
+// maxEmojiLen bounds the length of a reaction, in bytes. The longest ZWJ sequences (e.g., families) stay well below
+const maxEmojiLen = 64
+
+const (
+	zwj            = 0x200D
+	variationSel16 = 0xFE0F
+	keycapMark     = 0x20E3
+	blackFlag      = 0x1F3F4
+	cancelTag      = 0xE007F
+)
+
+// pictographic contains the ranges of code points that can be shown as emoji. It is an approximation of the Unicode
+// Extended_Pictographic property, which is not available in the standard library
+var pictographic = [][2]rune{
+	{0x00A9, 0x00A9}, {0x00AE, 0x00AE}, {0x203C, 0x203C}, {0x2049, 0x2049},
+	{0x2122, 0x2122}, {0x2139, 0x2139}, {0x2194, 0x2199}, {0x21A9, 0x21AA},
+	{0x231A, 0x231B}, {0x2328, 0x2328}, {0x23CF, 0x23CF}, {0x23E9, 0x23F3},
+	{0x23F8, 0x23FA}, {0x24C2, 0x24C2}, {0x25AA, 0x25AB}, {0x25B6, 0x25B6},
+	{0x25C0, 0x25C0}, {0x25FB, 0x25FE}, {0x2600, 0x27BF}, {0x2934, 0x2935},
+	{0x2B05, 0x2B07}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55},
+	{0x3030, 0x3030}, {0x303D, 0x303D}, {0x3297, 0x3297}, {0x3299, 0x3299},
+	{0x1F000, 0x1F1E5}, {0x1F200, 0x1F3FA}, {0x1F400, 0x1FAFF},
+}
+
+func isPictographic(r rune) bool {
+	for _, rg := range pictographic {
+		if r >= rg[0] && r <= rg[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool { return r >= 0x1F1E6 && r <= 0x1F1FF }
+
+func isSkinTone(r rune) bool { return r >= 0x1F3FB && r <= 0x1F3FF }
+
+func isTag(r rune) bool { return r >= 0xE0020 && r <= 0xE007E }
+
+// IsSingle reports whether s is exactly one emoji grapheme: a pictograph with optional presentation selector and
+// skin tone, a ZWJ sequence of those, a flag (pair of regional indicators or tag sequence) or a keycap
+func IsSingle(s string) bool {
+	if s == "" || len(s) > maxEmojiLen || !utf8.ValidString(s) {
+		return false
+	}
+	rs := []rune(s)
+
+	// flags
+	if isRegionalIndicator(rs[0]) {
+		return len(rs) == 2 && isRegionalIndicator(rs[1])
+	}
+	if rs[0] == blackFlag && len(rs) > 2 && rs[len(rs)-1] == cancelTag {
+		for _, r := range rs[1 : len(rs)-1] {
+			if !isTag(r) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// keycaps (e.g., 1️⃣)
+	if (rs[0] >= '0' && rs[0] <= '9') || rs[0] == '#' || rs[0] == '*' {
+		switch {
+		case len(rs) == 2:
+			return rs[1] == keycapMark
+		case len(rs) == 3:
+			return rs[1] == variationSel16 && rs[2] == keycapMark
+		}
+		return false
+	}
+
+	// pictographs joined by ZWJ, each followed by optional modifiers
+	i := 0
+	for {
+		if i >= len(rs) || !isPictographic(rs[i]) {
+			return false
+		}
+		i++
+		if i < len(rs) && rs[i] == variationSel16 {
+			i++
+		}
+		if i < len(rs) && isSkinTone(rs[i]) {
+			i++
+		}
+		if i == len(rs) {
+			return true
+		}
+		if rs[i] != zwj {
+			return false
+		}
+		i++
+	}
+}
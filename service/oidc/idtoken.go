@@ -0,0 +1,217 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+	"wasa-project/service/globaltime"
+)
+
+// ErrInvalidIDToken is returned when the ID token cannot be trusted
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// keysRefreshInterval is the minimum time between two downloads of the provider keys
+const keysRefreshInterval = time.Minute
+
+// IDToken contains the verified claims of an ID token
+type IDToken struct {
+	Issuer            string
+	Subject           string
+	Expiry            time.Time
+	Name              string
+	PreferredUsername string
+	Email             string
+}
+
+type keySet struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// audience accepts both forms of the "aud" claim: a single string or an array
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// verify checks signature, issuer, audience, expiry and nonce of the raw ID token
+func (p *Provider) verify(ctx context.Context, raw, nonce string) (*IDToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidIDToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidIDToken)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIDToken, header.Alg)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidIDToken)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidIDToken)
+	}
+
+	var claims struct {
+		Issuer            string   `json:"iss"`
+		Subject           string   `json:"sub"`
+		Audience          audience `json:"aud"`
+		Expiry            int64    `json:"exp"`
+		Nonce             string   `json:"nonce"`
+		Name              string   `json:"name"`
+		PreferredUsername string   `json:"preferred_username"`
+		Email             string   `json:"email"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad payload", ErrInvalidIDToken)
+	}
+	if claims.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidIDToken)
+	}
+	if !claims.Audience.contains(p.cfg.ClientID) {
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidIDToken)
+	}
+	if globaltime.Now().Unix() >= claims.Expiry {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	return &IDToken{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		Expiry:            time.Unix(claims.Expiry, 0).UTC(),
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+		Email:             claims.Email,
+	}, nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the provider key with the given ID. Keys are downloaded again when an unknown key ID shows up (the
+// provider may have rotated them), but not more often than keysRefreshInterval. The lock is not held during the
+// download.
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	keys := p.keys
+	p.mu.Unlock()
+
+	if keys != nil {
+		if k, ok := keys.lookup(kid); ok {
+			return k, nil
+		}
+		if globaltime.Since(keys.fetched) < keysRefreshInterval {
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.doJSON(req, &jwks); err != nil {
+		return nil, fmt.Errorf("loading the provider keys: %w", err)
+	}
+
+	set := &keySet{keys: map[string]*rsa.PublicKey{}, fetched: globaltime.Now()}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		set.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.mu.Lock()
+	p.keys = set
+	p.mu.Unlock()
+
+	if k, ok := set.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+}
+
+// lookup finds the key by ID. Tokens without a key ID are accepted only if the provider has a single key.
+func (s *keySet) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k, true
+		}
+	}
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+func decodeSegment(seg string, out interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,187 @@
+/*
+Package oidc implements the subset of OpenID Connect needed to log users in with an external identity provider: the
+authorization code flow, with the ID token verified against the provider keys (RS256 only).
+
+The provider endpoints are read from its discovery document (`<issuer>/.well-known/openid-configuration`) the first
+time they are needed, so the web server can start even if the identity provider is temporarily unreachable.
+*/
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is used to provide the identity provider details to New
+type Config struct {
+	// Issuer is the issuer URL of the identity provider. An empty issuer means that OIDC login is disabled
+	Issuer string
+	// ClientID and ClientSecret are the credentials of this application on the identity provider
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the URL of the callback endpoint, as registered on the identity provider
+	RedirectURL string
+
+	// HTTPClient is used for all requests to the identity provider. If nil, a client with a 10 seconds timeout is used
+	HTTPClient *http.Client
+}
+
+// Provider is an OpenID Connect identity provider
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu   sync.Mutex
+	meta *metadata
+	keys *keySet
+}
+
+// metadata is the part of the discovery document we use
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// New returns a new Provider. Issuer, client ID and redirect URL are required.
+func New(cfg Config) (*Provider, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("issuer is required")
+	}
+	if cfg.ClientID == "" {
+		return nil, errors.New("client ID is required")
+	}
+	if cfg.RedirectURL == "" {
+		return nil, errors.New("redirect URL is required")
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{cfg: cfg, client: client}, nil
+}
+
+// Issuer returns the issuer URL of the provider
+func (p *Provider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// AuthCodeURL returns the URL of the provider login page. The state is returned to the callback as is, while the nonce
+// will be embedded in the ID token.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.cfg.ClientID},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"scope":         {"openid profile email"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems the authorization code at the token endpoint, and returns the verified ID token. The token nonce
+// must match the one sent with AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (*IDToken, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.cfg.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.doJSON(req, &tokens); err != nil {
+		return nil, fmt.Errorf("exchanging the code: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("no id_token in token response")
+	}
+
+	return p.verify(ctx, tokens.IDToken, nonce)
+}
+
+// discover loads (once) the discovery document of the provider. The lock is not held during the request, so a slow
+// provider doesn't block the logins that already have the document.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+	if meta != nil {
+		return meta, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	meta = &metadata{}
+	if err := p.doJSON(req, meta); err != nil {
+		return nil, fmt.Errorf("loading the discovery document: %w", err)
+	}
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+
+	// se un'altra richiesta l'ha caricato nel frattempo, vale il primo
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta == nil {
+		p.meta = meta
+	}
+	return p.meta, nil
+}
+
+// maxResponseSize caps the responses read from the provider
+const maxResponseSize = 1 << 20
+
+func (p *Provider) doJSON(req *http.Request, out interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL.Host)
+	}
+	return json.Unmarshal(body, out)
+}
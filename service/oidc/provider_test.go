@@ -0,0 +1,302 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wasa-project/service/globaltime"
+)
+
+const (
+	testClientID     = "wasa"
+	testClientSecret = "s3cret"
+	testCode         = "the-code"
+	testKeyID        = "key-1"
+)
+
+// testIdP is an identity provider served by httptest: discovery document, keys and token endpoint. The token
+// endpoint returns the ID token built by the token function.
+type testIdP struct {
+	srv   *httptest.Server
+	key   *rsa.PrivateKey
+	token func() string
+
+	discoveries int32
+	keyFetches  int32
+	// keysHeld, if set, makes the keys endpoint wait until it's closed
+	keysHeld chan struct{}
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	idp := &testIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idp.discoveries, 1)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.srv.URL,
+			"authorization_endpoint": idp.srv.URL + "/authorize",
+			"token_endpoint":         idp.srv.URL + "/token",
+			"jwks_uri":               idp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idp.keyFetches, 1)
+		if idp.keysHeld != nil {
+			<-idp.keysHeld
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": testKeyID,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if r.Method != http.MethodPost || !ok || id != testClientID || secret != testClientSecret ||
+			r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != testCode {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idp.token()})
+	})
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// provider returns a Provider configured for the identity provider
+func (idp *testIdP) provider(t *testing.T) *Provider {
+	t.Helper()
+	p, err := New(Config{
+		Issuer:       idp.srv.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  "http://app.example/callback",
+		HTTPClient:   idp.srv.Client(),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return p
+}
+
+// claims returns valid claims for the nonce, expiring in an hour
+func (idp *testIdP) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                idp.srv.URL,
+		"sub":                "user-42",
+		"aud":                testClientID,
+		"exp":                globaltime.Now().Add(time.Hour).Unix(),
+		"nonce":              nonce,
+		"name":               "Ada Lovelace",
+		"preferred_username": "ada",
+		"email":              "ada@example.com",
+	}
+}
+
+// sign builds an RS256 JWT with the claims, signed by key. It runs in the handler of the token endpoint, so it panics
+// instead of failing the test.
+func sign(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		panic(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := newTestIdP(t)
+	raw, err := idp.provider(t).AuthCodeURL(context.Background(), "st", "no")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	q := u.Query()
+	if !strings.HasPrefix(raw, idp.srv.URL+"/authorize?") || q.Get("client_id") != testClientID ||
+		q.Get("state") != "st" || q.Get("nonce") != "no" || q.Get("response_type") != "code" {
+		t.Errorf("AuthCodeURL = %s", raw)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.token = func() string { return sign(idp.key, testKeyID, idp.claims("n1")) }
+	p := idp.provider(t)
+
+	idt, err := p.Exchange(context.Background(), testCode, "n1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if idt.Issuer != idp.srv.URL || idt.Subject != "user-42" || idt.PreferredUsername != "ada" ||
+		idt.Name != "Ada Lovelace" || idt.Email != "ada@example.com" {
+		t.Errorf("Exchange = %+v", idt)
+	}
+
+	// discovery e chiavi si scaricano una volta sola
+	if _, err := p.Exchange(context.Background(), testCode, "n1"); err != nil {
+		t.Fatalf("second Exchange: %v", err)
+	}
+	if d, k := atomic.LoadInt32(&idp.discoveries), atomic.LoadInt32(&idp.keyFetches); d != 1 || k != 1 {
+		t.Errorf("discovery fetched %d times, keys %d times, want 1 and 1", d, k)
+	}
+}
+
+func TestExchangeBadCode(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.token = func() string { return sign(idp.key, testKeyID, idp.claims("n1")) }
+
+	if _, err := idp.provider(t).Exchange(context.Background(), "wrong", "n1"); err == nil {
+		t.Fatal("Exchange: expected an error")
+	}
+}
+
+func TestExchangeInvalidToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token func(idp *testIdP) string
+	}{
+		{"bad signature", func(idp *testIdP) string {
+			return sign(otherKey, testKeyID, idp.claims("n1"))
+		}},
+		{"tampered payload", func(idp *testIdP) string {
+			parts := strings.Split(sign(idp.key, testKeyID, idp.claims("n1")), ".")
+			c := idp.claims("n1")
+			c["sub"] = "admin"
+			payload, _ := json.Marshal(c)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}},
+		{"wrong nonce", func(idp *testIdP) string {
+			return sign(idp.key, testKeyID, idp.claims("other"))
+		}},
+		{"missing nonce", func(idp *testIdP) string {
+			c := idp.claims("n1")
+			delete(c, "nonce")
+			return sign(idp.key, testKeyID, c)
+		}},
+		{"expired", func(idp *testIdP) string {
+			c := idp.claims("n1")
+			c["exp"] = globaltime.Now().Add(-time.Second).Unix()
+			return sign(idp.key, testKeyID, c)
+		}},
+		{"wrong issuer", func(idp *testIdP) string {
+			c := idp.claims("n1")
+			c["iss"] = "https://evil.example"
+			return sign(idp.key, testKeyID, c)
+		}},
+		{"wrong audience", func(idp *testIdP) string {
+			c := idp.claims("n1")
+			c["aud"] = []string{"someone-else"}
+			return sign(idp.key, testKeyID, c)
+		}},
+		{"unknown key", func(idp *testIdP) string {
+			return sign(idp.key, "key-2", idp.claims("n1"))
+		}},
+		{"malformed", func(idp *testIdP) string {
+			return "not.a-jwt"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			idp.token = func() string { return tt.token(idp) }
+
+			_, err := idp.provider(t).Exchange(context.Background(), testCode, "n1")
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("Exchange: err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	p, err := New(Config{
+		Issuer:      idp.srv.URL + "/",
+		ClientID:    testClientID,
+		RedirectURL: "http://app.example/callback",
+		HTTPClient:  idp.srv.Client(),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := p.AuthCodeURL(context.Background(), "st", "no"); err == nil {
+		t.Fatal("AuthCodeURL: expected an error for a different issuer")
+	}
+}
+
+func TestSlowKeysDoNotBlock(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.token = func() string { return sign(idp.key, testKeyID, idp.claims("n1")) }
+	idp.keysHeld = make(chan struct{})
+	p := idp.provider(t)
+	if _, err := p.AuthCodeURL(context.Background(), "st", "no"); err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Exchange(context.Background(), testCode, "n1")
+		done <- err
+	}()
+	for atomic.LoadInt32(&idp.keyFetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// mentre le chiavi si scaricano, gli altri login non restano in attesa
+	urlDone := make(chan error, 1)
+	go func() {
+		_, err := p.AuthCodeURL(context.Background(), "st2", "no2")
+		urlDone <- err
+	}()
+	select {
+	case err := <-urlDone:
+		if err != nil {
+			t.Errorf("AuthCodeURL: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("AuthCodeURL blocked by the download of the keys")
+	}
+
+	close(idp.keysHeld)
+	if err := <-done; err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Package ratelimit implements token bucket rate limiting. Each key (e.g., a client IP or a user ID) has its own bucket
+holding up to Limit.Burst tokens, refilled at a rate of Burst tokens every Limit.Per. Every request takes a token, and
+it's rejected when the bucket is empty.
+
+Buckets are kept in a Store: MemoryStore keeps them in the process memory, which is fine for a single instance. A
+shared store (e.g., backed by Redis) can be plugged in by implementing the Store interface.
+*/
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is the rate allowed for a key: Burst requests every Per. The zero value means no limit
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// Disabled reports whether the limit lets all requests through
+func (l Limit) Disabled() bool {
+	return l.Burst <= 0 || l.Per <= 0
+}
+
+func (l Limit) String() string {
+	if l.Disabled() {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/%s", l.Burst, l.Per)
+}
+
+// ParseLimit parses a limit in the form "<requests>/<duration>", like "10/1m" or "100/1h". An empty string or "0" means
+// no limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: expected <requests>/<duration>", s)
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || burst < 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: bad number of requests", s)
+	}
+	per, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || per <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: bad duration", s)
+	}
+	return Limit{Burst: burst, Per: per}, nil
+}
+
+// Result is the outcome of Store.Allow
+type Result struct {
+	// Allowed is true if the request can go on
+	Allowed bool
+	// RetryAfter is how long the client should wait before the next token is available (only when not allowed)
+	RetryAfter time.Duration
+}
+
+// ErrStoreUnavailable can be returned by stores that depend on an external service. Callers usually let the request
+// through in this case, rather than blocking everyone.
+var ErrStoreUnavailable = errors.New("rate limit store unavailable")
+
+// Store keeps the buckets and takes tokens from them
+type Store interface {
+	// Allow takes a token from the bucket of the key, creating it if needed
+	Allow(key string, limit Limit) (Result, error)
+}
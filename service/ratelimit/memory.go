@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+	"wasa-project/service/globaltime"
+)
+
+// sweepInterval is the minimum time between two cleanups of the idle buckets
+const sweepInterval = time.Minute
+
+// MemoryStore is a Store that keeps the buckets in memory. It's safe for concurrent use.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   map[string]*bucket{},
+		lastSweep: globaltime.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the key. It never returns an error.
+func (s *MemoryStore) Allow(key string, limit Limit) (Result, error) {
+	if limit.Disabled() {
+		return Result{Allowed: true}, nil
+	}
+	now := globaltime.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		s.buckets[key] = b
+	}
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return Result{Allowed: true}, nil
+	}
+	missing := 1 - b.tokens
+	wait := time.Duration(math.Ceil(missing / b.rate() * float64(time.Second)))
+	return Result{Allowed: false, RetryAfter: wait}, nil
+}
+
+// rate returns the refill rate in tokens per second
+func (b *bucket) rate() float64 {
+	return float64(b.limit.Burst) / b.limit.Per.Seconds()
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.rate())
+	b.last = now
+}
+
+// sweep drops the buckets that have been idle long enough to be full again: they are the same as a new bucket.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if now.Sub(b.last) >= b.limit.Per {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+	"wasa-project/service/globaltime"
+)
+
+// setTime fixes the clock used by the store for the rest of the test
+func setTime(t *testing.T, at time.Time) {
+	t.Helper()
+	globaltime.FixedTime = at
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+}
+
+var start = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// take calls Allow n times and returns how many requests were allowed
+func take(t *testing.T, s *MemoryStore, key string, limit Limit, n int) int {
+	t.Helper()
+	allowed := 0
+	for i := 0; i < n; i++ {
+		res, err := s.Allow(key, limit)
+		if err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		if res.Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestMemoryStoreBurst(t *testing.T) {
+	setTime(t, start)
+	s := NewMemoryStore()
+	limit := Limit{Burst: 3, Per: time.Minute}
+
+	if got := take(t, s, "a", limit, 5); got != 3 {
+		t.Errorf("allowed %d requests at once, want the burst of 3", got)
+	}
+	// ogni chiave ha il suo bucket
+	if got := take(t, s, "b", limit, 1); got != 1 {
+		t.Error("another key was limited too")
+	}
+	// un limite disattivato lascia passare tutto
+	if got := take(t, s, "a", Limit{}, 10); got != 10 {
+		t.Errorf("allowed %d requests with no limit, want 10", got)
+	}
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	setTime(t, start)
+	s := NewMemoryStore()
+	limit := Limit{Burst: 3, Per: time.Minute}
+	take(t, s, "a", limit, 3)
+
+	// un terzo di Per ricarica un gettone
+	setTime(t, start.Add(20*time.Second))
+	if got := take(t, s, "a", limit, 3); got != 1 {
+		t.Errorf("allowed %d requests after Per/3, want 1", got)
+	}
+
+	// dopo Per il bucket è di nuovo pieno, ma non oltre il burst
+	setTime(t, start.Add(20*time.Second+2*time.Minute))
+	if got := take(t, s, "a", limit, 5); got != 3 {
+		t.Errorf("allowed %d requests after Per, want 3", got)
+	}
+}
+
+func TestMemoryStoreRetryAfter(t *testing.T) {
+	setTime(t, start)
+	s := NewMemoryStore()
+	limit := Limit{Burst: 3, Per: time.Minute}
+	take(t, s, "a", limit, 3)
+
+	// un gettone ogni 20 secondi
+	res, err := s.Allow("a", limit)
+	if err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	if res.Allowed || res.RetryAfter != 20*time.Second {
+		t.Errorf("Allow = %+v, want refused with RetryAfter 20s", res)
+	}
+
+	setTime(t, start.Add(5*time.Second))
+	res, err = s.Allow("a", limit)
+	if err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	if res.Allowed || res.RetryAfter != 15*time.Second {
+		t.Errorf("Allow after 5s = %+v, want refused with RetryAfter 15s", res)
+	}
+
+	// allo scadere di RetryAfter la richiesta passa
+	setTime(t, start.Add(20*time.Second))
+	if got := take(t, s, "a", limit, 1); got != 1 {
+		t.Error("request refused after RetryAfter")
+	}
+}
@@ -0,0 +1,606 @@
+/*
+Package richtext implements the formatting of messages, a small subset of Markdown:
+
+	**bold**  _italic_ (or *italic*)  ~~strikethrough~~  `inline code`  [label](https://example.com)
+
+	```go
+	code block, with an optional language
+	```
+
+Parse turns the source written by the user into the plain text and a list of entities that say how to render it,
+so that every client shows the same thing and none has to interpret Markdown. Offsets and lengths of entities are in
+UTF-16 code units, like the indexes of JavaScript strings. Markers that are not closed stay in the text as they are,
+and so do links whose URL is not valid; a backslash escapes the next marker character. Parsing takes linear time in
+the length of the source.
+*/
+package richtext
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Entity types
+const (
+	Bold          = "bold"
+	Italic        = "italic"
+	Strikethrough = "strikethrough"
+	Code          = "code"
+	Pre           = "pre"
+	Link          = "link"
+)
+
+// Limits of a message
+const (
+	// MaxEntities is the maximum number of entities of a message
+	MaxEntities = 100
+	// MaxURLLength is the maximum length of the URL of a link
+	MaxURLLength = 2048
+	// maxLanguageLength is the maximum length of the language of a code block
+	maxLanguageLength = 32
+)
+
+var (
+	// ErrTooManyEntities is returned when a text has more than MaxEntities entities
+	ErrTooManyEntities = errors.New("too many formatting entities")
+	// ErrInvalidURL is returned by Validate for links to URLs that are not absolute http(s) or mailto URLs
+	ErrInvalidURL = errors.New("invalid link URL")
+	// ErrInvalidEntity is returned for entities out of the text, of unknown type or overlapping other entities
+	ErrInvalidEntity = errors.New("invalid formatting entity")
+)
+
+// Entity is a formatted span of a text. URL is set only for links, Language only (and optionally) for code blocks.
+type Entity struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	URL      string `json:"url,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// Parse returns the plain text of the source and its entities, sorted by offset (outer entities first). It fails only
+// if there are too many entities.
+func Parse(src string) (string, []Entity, error) {
+	p := newParser(src)
+	p.scan()
+	p.emphasis(nil)
+	text, entities, err := p.result()
+	if err != nil {
+		return "", nil, err
+	}
+	sortEntities(entities)
+	if err := Validate(text, entities); err != nil {
+		return "", nil, err
+	}
+	return text, entities, nil
+}
+
+// Validate checks that the entities are sorted like Parse returns them, inside the text and properly nested, that
+// code spans contain no other entity and that links are safe.
+func Validate(text string, entities []Entity) error {
+	if len(entities) > MaxEntities {
+		return ErrTooManyEntities
+	}
+	size := UTF16Len(text)
+
+	// pila delle entità che contengono quella corrente
+	var open []Entity
+	for i, e := range entities {
+		if e.Offset < 0 || e.Length <= 0 || e.Offset+e.Length > size {
+			return ErrInvalidEntity
+		}
+		switch e.Type {
+		case Bold, Italic, Strikethrough, Code:
+			if e.URL != "" || e.Language != "" {
+				return ErrInvalidEntity
+			}
+		case Pre:
+			if e.URL != "" || !validLanguage(e.Language) {
+				return ErrInvalidEntity
+			}
+		case Link:
+			if e.Language != "" {
+				return ErrInvalidEntity
+			}
+			if !validURL(e.URL) {
+				return ErrInvalidURL
+			}
+		default:
+			return ErrInvalidEntity
+		}
+		if i > 0 {
+			prev := entities[i-1]
+			if e.Offset < prev.Offset || e.Offset == prev.Offset && e.Length > prev.Length {
+				return ErrInvalidEntity
+			}
+		}
+
+		for len(open) > 0 && open[len(open)-1].Offset+open[len(open)-1].Length <= e.Offset {
+			open = open[:len(open)-1]
+		}
+		if len(open) > 0 {
+			parent := open[len(open)-1]
+			if e.Offset+e.Length > parent.Offset+parent.Length || parent.Type == Code || parent.Type == Pre {
+				return ErrInvalidEntity
+			}
+		}
+		open = append(open, e)
+	}
+	return nil
+}
+
+// UTF16Len returns the length of s in UTF-16 code units
+func UTF16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// validURL reports whether u is an absolute http(s) URL with a host, or a mailto URL
+func validURL(u string) bool {
+	if u == "" || len(u) > MaxURLLength || strings.ContainsAny(u, " \t\r\n") {
+		return false
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+		return parsed.Host != ""
+	case "mailto":
+		return parsed.Opaque != ""
+	}
+	return false
+}
+
+// validLanguage reports whether s can be the language of a code block, like "go" or "c++"
+func validLanguage(s string) bool {
+	if len(s) > maxLanguageLength {
+		return false
+	}
+	for _, r := range s {
+		if !isWordRune(r) && !strings.ContainsRune("+#-.", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// sortEntities sorts the entities by offset, the outer ones first
+func sortEntities(entities []Entity) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		if entities[i].Offset != entities[j].Offset {
+			return entities[i].Offset < entities[j].Offset
+		}
+		return entities[i].Length > entities[j].Length
+	})
+}
+
+// The source is parsed in two steps, like in CommonMark. First it's scanned once, left to right, into a list of nodes:
+// plain text, code spans and blocks (complete entities), link brackets and runs of emphasis markers ("delimiters").
+// Links are closed during the scan; emphasis is matched afterwards (and inside a link label when the link closes) by
+// walking the delimiters once, so that the time stays linear in the length of the source. Matched entities are marked
+// with open and close nodes, and the delimiters that are left become plain text.
+
+// node kinds
+const (
+	textNode = iota
+	bracketNode
+	delimNode
+	openNode
+	closeNode
+)
+
+// node is an element of the parsed source. A text node holds text (a bracket node a "[" that may become a link), a
+// delimiter node a run of count markers, and open/close nodes the boundaries of an entity.
+type node struct {
+	kind   int
+	text   []byte
+	marker byte
+	count  int
+	entity Entity
+	prev   *node
+	next   *node
+}
+
+// delim is a run of emphasis markers that can still open or close a span. before and after report whether the run is
+// at a word boundary on that side, which is required by the single-character markers.
+type delim struct {
+	node     *node
+	marker   byte
+	count    int
+	canOpen  bool
+	canClose bool
+	before   bool
+	after    bool
+	index    int
+	prev     *delim
+	next     *delim
+}
+
+// bracket is a "[" that can still open a link. delims is the last delimiter before it.
+type bracket struct {
+	node   *node
+	delims *delim
+}
+
+// finder finds the next occurrence of sub in a string, remembering the last one found, so that the repeated searches
+// from increasing positions of a scan take linear time overall
+type finder struct {
+	sub      string
+	at       int
+	searched bool
+}
+
+// next returns the index of the first occurrence of sub in s at or after from, or -1. from must not decrease between
+// calls.
+func (f *finder) next(s string, from int) int {
+	if f.searched && (f.at < 0 || from <= f.at) {
+		return f.at
+	}
+	f.searched = true
+	f.at = strings.Index(s[from:], f.sub)
+	if f.at >= 0 {
+		f.at += from
+	}
+	return f.at
+}
+
+// parser holds the nodes and the delimiters of the source being parsed
+type parser struct {
+	src       string
+	head      *node
+	tail      *node
+	delims    *delim
+	brackets  []bracket
+	lastIndex int
+	fence     finder
+	backtick  finder
+	paren     finder
+}
+
+func newParser(src string) *parser {
+	return &parser{
+		src:      src,
+		fence:    finder{sub: "```"},
+		backtick: finder{sub: "`"},
+		paren:    finder{sub: ")"},
+	}
+}
+
+// append adds a node at the end of the list
+func (p *parser) append(n *node) *node {
+	n.prev = p.tail
+	if p.tail != nil {
+		p.tail.next = n
+	} else {
+		p.head = n
+	}
+	p.tail = n
+	return n
+}
+
+// insertAfter adds n right after the node at
+func (p *parser) insertAfter(at, n *node) {
+	n.prev, n.next = at, at.next
+	if at.next != nil {
+		at.next.prev = n
+	} else {
+		p.tail = n
+	}
+	at.next = n
+}
+
+// insertBefore adds n right before the node at
+func (p *parser) insertBefore(at, n *node) {
+	n.prev, n.next = at.prev, at
+	if at.prev != nil {
+		at.prev.next = n
+	} else {
+		p.head = n
+	}
+	at.prev = n
+}
+
+func (p *parser) text(s string) {
+	if p.tail != nil && p.tail.kind == textNode {
+		p.tail.text = append(p.tail.text, s...)
+		return
+	}
+	p.append(&node{kind: textNode, text: []byte(s)})
+}
+
+// entity adds a complete entity around the text s, like a code span
+func (p *parser) entity(e Entity, s string) {
+	p.append(&node{kind: openNode, entity: e})
+	p.append(&node{kind: textNode, text: []byte(s)})
+	p.append(&node{kind: closeNode})
+}
+
+// removeDelim takes d out of the delimiters. Its node stays, and its markers become plain text.
+func (p *parser) removeDelim(d *delim) {
+	if d.prev != nil {
+		d.prev.next = d.next
+	}
+	if d.next != nil {
+		d.next.prev = d.prev
+	} else {
+		p.delims = d.prev
+	}
+	d.node.count = d.count
+}
+
+// scan builds the nodes of the source, closing the links on the way
+func (p *parser) scan() {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		// carattere di escape
+		if c == '\\' && i+1 < len(s) && strings.IndexByte("\\*_~`[]()", s[i+1]) >= 0 {
+			p.text(s[i+1 : i+2])
+			i += 2
+			continue
+		}
+
+		if strings.HasPrefix(s[i:], "```") {
+			if end := p.fence.next(s, i+3); end >= 0 {
+				body := s[i+3 : end]
+				lang := ""
+				if nl := strings.IndexByte(body, '\n'); nl >= 0 && validLanguage(body[:nl]) {
+					lang, body = body[:nl], body[nl+1:]
+				}
+				p.entity(Entity{Type: Pre, Language: lang}, strings.TrimSuffix(body, "\n"))
+				i = end + 3
+				continue
+			}
+		}
+
+		if c == '`' {
+			if end := p.backtick.next(s, i+1); end > i+1 {
+				p.entity(Entity{Type: Code}, s[i+1:end])
+				i = end + 1
+				continue
+			}
+		}
+
+		switch c {
+		case '[':
+			n := p.append(&node{kind: bracketNode, text: []byte("[")})
+			p.brackets = append(p.brackets, bracket{node: n, delims: p.delims})
+			i++
+			continue
+		case ']':
+			if n := p.link(i); n > 0 {
+				i += n
+				continue
+			}
+		case '\n':
+			// un link non va a capo
+			p.brackets = p.brackets[:0]
+		case '*', '_', '~':
+			i += p.run(i)
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		p.text(s[i : i+size])
+		i += size
+	}
+}
+
+// run adds the run of markers starting at s[i], and returns its length
+func (p *parser) run(i int) int {
+	s := p.src
+	c := s[i]
+	n := 1
+	for i+n < len(s) && s[i+n] == c {
+		n++
+	}
+	// "_" vale solo da solo, "~" solo a coppie
+	if c == '_' && n > 1 || c == '~' && n < 2 {
+		p.text(s[i : i+n])
+		return n
+	}
+
+	before, _ := utf8.DecodeLastRuneInString(s[:i])
+	after, _ := utf8.DecodeRuneInString(s[i+n:])
+	d := &delim{
+		node:     p.append(&node{kind: delimNode, marker: c, count: n}),
+		marker:   c,
+		count:    n,
+		canOpen:  i+n < len(s) && !unicode.IsSpace(after),
+		canClose: i > 0 && !unicode.IsSpace(before),
+		before:   i == 0 || !isWordRune(before),
+		after:    i+n == len(s) || !isWordRune(after),
+		index:    p.lastIndex + 1,
+		prev:     p.delims,
+	}
+	p.lastIndex++
+	if p.delims != nil {
+		p.delims.next = d
+	}
+	p.delims = d
+	return n
+}
+
+// link closes the link whose label ends with the "]" at s[i], and returns the number of bytes of "](url)". It returns
+// 0 if there's no link: no open bracket, an empty label, or a missing or invalid URL. Then the text stays as it is.
+func (p *parser) link(i int) int {
+	s := p.src
+	if len(p.brackets) == 0 {
+		return 0
+	}
+	b := p.brackets[len(p.brackets)-1]
+	p.brackets = p.brackets[:len(p.brackets)-1]
+	if i+1 >= len(s) || s[i+1] != '(' || b.node == p.tail {
+		return 0
+	}
+	end := p.paren.next(s, i+2)
+	if end < 0 || !validURL(s[i+2:end]) {
+		return 0
+	}
+
+	// l'enfasi dentro l'etichetta si chiude dentro l'etichetta
+	p.emphasis(b.delims)
+	b.node.text = nil
+	p.insertAfter(b.node, &node{kind: openNode, entity: Entity{Type: Link, URL: s[i+2 : end]}})
+	p.append(&node{kind: closeNode})
+	// niente link dentro i link
+	p.brackets = p.brackets[:0]
+	return end + 1 - i
+}
+
+// emphasisKey identifies the closers that can match the same openers
+type emphasisKey struct {
+	marker byte
+	double bool
+	after  bool
+}
+
+// emphasis matches the delimiters after bottom (all of them if nil), and then removes them
+func (p *parser) emphasis(bottom *delim) {
+	bottomIndex := 0
+	closer := p.delims
+	if bottom != nil {
+		bottomIndex = bottom.index
+	}
+	// il primo delimitatore dopo bottom
+	for closer != nil && closer.prev != nil && closer.prev.index > bottomIndex {
+		closer = closer.prev
+	}
+	if closer != nil && closer.index <= bottomIndex {
+		closer = nil
+	}
+
+	// per ogni tipo di chiusura, fin dove è inutile cercare un'apertura
+	openersBottom := make(map[emphasisKey]int)
+	for closer != nil {
+		if !closer.canClose {
+			closer = closer.next
+			continue
+		}
+		key := emphasisKey{closer.marker, closer.count >= 2, closer.after}
+		limit := bottomIndex
+		if l, ok := openersBottom[key]; ok && l > limit {
+			limit = l
+		}
+
+		var opener *delim
+		for o := closer.prev; o != nil && o.index > limit; o = o.prev {
+			if o.marker == closer.marker && o.canOpen && matches(o, closer) {
+				opener = o
+				break
+			}
+		}
+		if opener == nil {
+			if closer.prev != nil {
+				openersBottom[key] = closer.prev.index
+			}
+			next := closer.next
+			if !closer.canOpen {
+				p.removeDelim(closer)
+			}
+			closer = next
+			continue
+		}
+
+		e, use := Entity{Type: Italic}, 1
+		switch {
+		case closer.marker == '~':
+			e, use = Entity{Type: Strikethrough}, 2
+		case closer.marker == '*' && opener.count >= 2 && closer.count >= 2:
+			e, use = Entity{Type: Bold}, 2
+		}
+		p.insertAfter(opener.node, &node{kind: openNode, entity: e})
+		p.insertBefore(closer.node, &node{kind: closeNode})
+
+		// i delimitatori in mezzo restano testo
+		for d := closer.prev; d != opener; d = closer.prev {
+			p.removeDelim(d)
+		}
+		opener.count -= use
+		closer.count -= use
+		opener.node.count, closer.node.count = opener.count, closer.count
+		if opener.count == 0 {
+			p.removeDelim(opener)
+		}
+		if closer.count == 0 {
+			next := closer.next
+			p.removeDelim(closer)
+			closer = next
+		}
+	}
+
+	for p.delims != nil && p.delims.index > bottomIndex {
+		p.removeDelim(p.delims)
+	}
+}
+
+// matches reports whether the opener and the closer can make a span. Single-character spans (italic) must be at word
+// boundaries, so that snake_case_names and 2*3*4 stay as they are.
+func matches(opener, closer *delim) bool {
+	switch closer.marker {
+	case '~':
+		return opener.count >= 2 && closer.count >= 2
+	case '*':
+		if opener.count >= 2 && closer.count >= 2 {
+			return true
+		}
+	}
+	return opener.before && closer.after
+}
+
+// result returns the plain text and the entities of the nodes, in the order they open
+func (p *parser) result() (string, []Entity, error) {
+	var out strings.Builder
+	var entities []Entity
+	var open []int
+	pos := 0
+	for n := p.head; n != nil; n = n.next {
+		switch n.kind {
+		case textNode, bracketNode:
+			out.Write(n.text)
+			pos += UTF16Len(string(n.text))
+		case delimNode:
+			out.WriteString(strings.Repeat(string(n.marker), n.count))
+			pos += n.count
+		case openNode:
+			e := n.entity
+			e.Offset = pos
+			open = append(open, len(entities))
+			entities = append(entities, e)
+		case closeNode:
+			e := &entities[open[len(open)-1]]
+			open = open[:len(open)-1]
+			e.Length = pos - e.Offset
+		}
+	}
+
+	// le entità vuote non servono
+	out2 := entities[:0]
+	for _, e := range entities {
+		if e.Length > 0 {
+			out2 = append(out2, e)
+		}
+	}
+	if len(out2) > MaxEntities {
+		return "", nil, ErrTooManyEntities
+	}
+	return out.String(), out2, nil
+}
@@ -0,0 +1,123 @@
+package richtext
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		text     string
+		entities []Entity
+	}{
+		{"plain", "hello world", "hello world", nil},
+		{"bold", "a **b** c", "a b c", []Entity{{Type: Bold, Offset: 2, Length: 1}}},
+		{"italic star", "*it*", "it", []Entity{{Type: Italic, Offset: 0, Length: 2}}},
+		{"italic underscore", "_it_", "it", []Entity{{Type: Italic, Offset: 0, Length: 2}}},
+		{"strikethrough", "~~no~~", "no", []Entity{{Type: Strikethrough, Offset: 0, Length: 2}}},
+		{"code", "run `go test` now", "run go test now", []Entity{{Type: Code, Offset: 4, Length: 7}}},
+		{"code keeps markers", "`**x**`", "**x**", []Entity{{Type: Code, Offset: 0, Length: 5}}},
+		{"pre with language", "```go\nfmt.Println()\n```", "fmt.Println()",
+			[]Entity{{Type: Pre, Offset: 0, Length: 13, Language: "go"}}},
+		{"pre without language", "```x y\nz```", "x y\nz", []Entity{{Type: Pre, Offset: 0, Length: 5}}},
+		{"link", "see [docs](https://example.com) now", "see docs now",
+			[]Entity{{Type: Link, Offset: 4, Length: 4, URL: "https://example.com"}}},
+		{"bold link", "**[a](https://x.org)**", "a", []Entity{
+			{Type: Bold, Offset: 0, Length: 1},
+			{Type: Link, Offset: 0, Length: 1, URL: "https://x.org"},
+		}},
+		{"formatted label", "[**a** b](mailto:me@x.org)", "a b", []Entity{
+			{Type: Link, Offset: 0, Length: 3, URL: "mailto:me@x.org"},
+			{Type: Bold, Offset: 0, Length: 1},
+		}},
+		{"nested italic in bold", "**bold *it***", "bold it", []Entity{
+			{Type: Bold, Offset: 0, Length: 7},
+			{Type: Italic, Offset: 5, Length: 2},
+		}},
+		{"nested bold in italic", "*it **b***", "it b", []Entity{
+			{Type: Italic, Offset: 0, Length: 4},
+			{Type: Bold, Offset: 3, Length: 1},
+		}},
+		{"bold italic", "***x***", "x", []Entity{
+			{Type: Italic, Offset: 0, Length: 1},
+			{Type: Bold, Offset: 0, Length: 1},
+		}},
+		{"utf-16 offsets", "😀 **b**", "😀 b", []Entity{{Type: Bold, Offset: 3, Length: 1}}},
+		{"escape", `\*not\*`, "*not*", nil},
+		{"invalid link url", "look at [1](2) here", "look at [1](2) here", nil},
+		{"unsafe link scheme", "see [x](ftp://a)", "see [x](ftp://a)", nil},
+		{"javascript link", "[x](javascript:alert(1))", "[x](javascript:alert(1))", nil},
+		{"empty label", "[](https://x.org)", "[](https://x.org)", nil},
+		{"link across lines", "[a\nb](https://x.org)", "[a\nb](https://x.org)", nil},
+		{"unclosed", "**open *and _more", "**open *and _more", nil},
+		{"intraword star", "2*3*4", "2*3*4", nil},
+		{"snake case", "snake_case_name", "snake_case_name", nil},
+		{"spaces inside", "a * b * c", "a * b * c", nil},
+		{"single tilde", "~a~", "~a~", nil},
+		{"empty code", "``", "``", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, entities, err := Parse(tt.src)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.src, err)
+			}
+			if text != tt.text {
+				t.Errorf("Parse(%q) text = %q, want %q", tt.src, text, tt.text)
+			}
+			if !reflect.DeepEqual(entities, tt.entities) {
+				t.Errorf("Parse(%q) entities = %+v, want %+v", tt.src, entities, tt.entities)
+			}
+		})
+	}
+}
+
+func TestParseTooManyEntities(t *testing.T) {
+	src := strings.Repeat("**a** ", MaxEntities+1)
+	if _, _, err := Parse(src); !errors.Is(err, ErrTooManyEntities) {
+		t.Fatalf("Parse: err = %v, want ErrTooManyEntities", err)
+	}
+}
+
+func TestParseLinear(t *testing.T) {
+	// con una ricerca in avanti per ogni apertura questo richiederebbe minuti
+	src := strings.Repeat("**a ~~b _c [d](e ", 25000)
+	start := time.Now()
+	if _, _, err := Parse(src); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Parse of %d bytes took %v", len(src), d)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		entities []Entity
+		err      error
+	}{
+		{"ok", "abc", []Entity{{Type: Bold, Offset: 0, Length: 3}, {Type: Italic, Offset: 1, Length: 1}}, nil},
+		{"out of text", "abc", []Entity{{Type: Bold, Offset: 2, Length: 2}}, ErrInvalidEntity},
+		{"overlapping", "abcd", []Entity{{Type: Bold, Offset: 0, Length: 2}, {Type: Italic, Offset: 1, Length: 2}},
+			ErrInvalidEntity},
+		{"inside code", "abc", []Entity{{Type: Code, Offset: 0, Length: 3}, {Type: Bold, Offset: 1, Length: 1}},
+			ErrInvalidEntity},
+		{"unknown type", "abc", []Entity{{Type: "blink", Offset: 0, Length: 1}}, ErrInvalidEntity},
+		{"bad url", "abc", []Entity{{Type: Link, Offset: 0, Length: 1, URL: "javascript:x"}}, ErrInvalidURL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.text, tt.entities); !errors.Is(err, tt.err) {
+				t.Errorf("Validate: err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config is used to provide the limits of the fetches to NewHTTPFetcher
+type Config struct {
+	// Timeout is the maximum duration of a fetch, redirects included. The default is 5 seconds
+	Timeout time.Duration
+	// MaxBytes is the maximum number of bytes read from a page. The default is 512 KiB
+	MaxBytes int64
+	// Allow lists the networks that can be fetched even if they are not public (e.g., an intranet)
+	Allow []*net.IPNet
+	// UserAgent is sent with the requests
+	UserAgent string
+}
+
+// maxRedirects is the maximum number of redirects followed by a fetch
+const maxRedirects = 3
+
+// blockedNets are the networks that are not reachable from the Internet, or that are reserved, and the IPv6 transition
+// prefixes (NAT64, Teredo, 6to4) that would reach IPv4 addresses through a gateway. Loopback, private, link-local,
+// multicast and unspecified addresses are checked apart.
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+	"2001::/32",
+	"2001:db8::/32",
+	"2002::/16",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// ParseAllowlist parses a comma-separated list of networks (like "10.1.0.0/16") and addresses (like "127.0.0.1")
+func ParseAllowlist(s string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", item)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// HTTPFetcher fetches the previews from the web. It's safe for concurrent use.
+type HTTPFetcher struct {
+	cfg    Config
+	client *http.Client
+}
+
+// NewHTTPFetcher returns a new HTTPFetcher
+func NewHTTPFetcher(cfg Config) *HTTPFetcher {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 512 << 10
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = "WASAText-LinkPreview/1.0"
+	}
+
+	f := &HTTPFetcher{cfg: cfg}
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		// il controllo è sull'indirizzo risolto, quindi vale anche dopo redirect e DNS
+		Control: f.checkAddress,
+	}
+	f.client = &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			// niente proxy: l'indirizzo controllato deve essere quello della pagina
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   cfg.Timeout,
+			ResponseHeaderTimeout: cfg.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return ErrBlockedAddress
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// checkAddress refuses the connections to addresses that are not public, unless allowlisted
+func (f *HTTPFetcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !f.allowed(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+// allowed reports whether the fetcher can connect to ip
+func (f *HTTPFetcher) allowed(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range f.cfg.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fetch downloads the page and reads its preview
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) (*Preview, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrBlockedAddress
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.cfg.UserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrNoPreview
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.cfg.MaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	// i link relativi (es. l'immagine) partono dall'URL finale, dopo i redirect
+	p := parseHTML(string(body), resp.Request.URL)
+	if p.Title == "" && p.Description == "" {
+		return nil, ErrNoPreview
+	}
+	p.URL = rawURL
+	return p, nil
+}
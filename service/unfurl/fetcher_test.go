@@ -0,0 +1,170 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const ogPage = `<html><head>
+<title>Fallback</title>
+<meta property="og:title" content="The &amp; title">
+<meta property="og:description" content="A   short
+description">
+<meta property="og:image" content="/img/cover.png">
+<meta property="og:site_name" content="Example">
+</head><body>hello</body></html>`
+
+// newFetcher returns an HTTPFetcher that can reach the httptest servers on 127.0.0.1
+func newFetcher(t *testing.T, cfg Config) *HTTPFetcher {
+	t.Helper()
+	allow, err := ParseAllowlist("127.0.0.1/32")
+	if err != nil {
+		t.Fatalf("ParseAllowlist: %v", err)
+	}
+	cfg.Allow = allow
+	return NewHTTPFetcher(cfg)
+}
+
+func htmlHandler(page string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = fmt.Fprint(w, page)
+	}
+}
+
+func TestFetchAllowlisted(t *testing.T) {
+	srv := httptest.NewServer(htmlHandler(ogPage))
+	defer srv.Close()
+
+	p, err := newFetcher(t, Config{}).Fetch(context.Background(), srv.URL+"/page")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	want := Preview{
+		URL:         srv.URL + "/page",
+		Title:       "The & title",
+		Description: "A short description",
+		ImageURL:    srv.URL + "/img/cover.png",
+		SiteName:    "Example",
+	}
+	if *p != want {
+		t.Errorf("Fetch = %+v, want %+v", *p, want)
+	}
+}
+
+func TestFetchNotAllowlisted(t *testing.T) {
+	srv := httptest.NewServer(htmlHandler(ogPage))
+	defer srv.Close()
+
+	_, err := NewHTTPFetcher(Config{}).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("Fetch: err = %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestFetchRedirectToBlockedAddress(t *testing.T) {
+	targets := []string{
+		"http://127.0.0.2/",
+		"http://[::1]/",
+		"http://10.0.0.1/",
+		"http://192.168.1.1/admin",
+		"http://169.254.169.254/latest/meta-data/",
+	}
+	for _, target := range targets {
+		t.Run(target, func(t *testing.T) {
+			srv := httptest.NewServer(http.RedirectHandler(target, http.StatusFound))
+			defer srv.Close()
+
+			_, err := newFetcher(t, Config{}).Fetch(context.Background(), srv.URL)
+			if !errors.Is(err, ErrBlockedAddress) {
+				t.Fatalf("Fetch: err = %v, want ErrBlockedAddress", err)
+			}
+		})
+	}
+}
+
+func TestFetchMaxBytes(t *testing.T) {
+	// la descrizione è dopo il limite, quindi non viene letta
+	page := `<html><head><meta property="og:title" content="Title">` + strings.Repeat(" ", 4096) +
+		`<meta property="og:description" content="Too far"></head></html>`
+	srv := httptest.NewServer(htmlHandler(page))
+	defer srv.Close()
+
+	p, err := newFetcher(t, Config{MaxBytes: 1024}).Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if p.Title != "Title" || p.Description != "" {
+		t.Errorf("Fetch = %+v, want only the title", *p)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := newFetcher(t, Config{Timeout: 100 * time.Millisecond}).Fetch(context.Background(), srv.URL)
+	if err == nil {
+		t.Fatal("Fetch: expected an error")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Fetch took %v, want about 100ms", d)
+	}
+}
+
+func TestFetchNotHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"title": "not a page"}`)
+	}))
+	defer srv.Close()
+
+	_, err := newFetcher(t, Config{}).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrNoPreview) {
+		t.Fatalf("Fetch: err = %v, want ErrNoPreview", err)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	f := NewHTTPFetcher(Config{})
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"64:ff9b::7f00:1", false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+		{"2002:7f00:1::1", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := f.allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package unfurl
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Maximum lengths of the fields of a preview, in characters
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 500
+	maxSiteNameLength    = 100
+)
+
+var (
+	metaTag   = regexp.MustCompile(`(?is)<meta\s([^>]*)>`)
+	attribute = regexp.MustCompile(`(?s)([a-zA-Z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	titleTag  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// parseHTML reads the preview from the head of the page. base is the URL of the page, used to resolve the image URL.
+func parseHTML(page string, base *url.URL) *Preview {
+	if end := strings.Index(strings.ToLower(page), "</head>"); end >= 0 {
+		page = page[:end]
+	}
+
+	meta := make(map[string]string)
+	for _, tag := range metaTag.FindAllStringSubmatch(page, -1) {
+		attrs := make(map[string]string)
+		for _, a := range attribute.FindAllStringSubmatch(tag[1], -1) {
+			attrs[strings.ToLower(a[1])] = a[2] + a[3] + a[4]
+		}
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		key = strings.ToLower(key)
+		// vale il primo tag con quel nome
+		if _, ok := meta[key]; key != "" && !ok {
+			meta[key] = attrs["content"]
+		}
+	}
+
+	p := &Preview{
+		Title:       first(meta["og:title"], meta["twitter:title"]),
+		Description: first(meta["og:description"], meta["twitter:description"], meta["description"]),
+		SiteName:    meta["og:site_name"],
+	}
+	if p.Title == "" {
+		if m := titleTag.FindStringSubmatch(page); m != nil {
+			p.Title = m[1]
+		}
+	}
+	p.Title = clean(p.Title, maxTitleLength)
+	p.Description = clean(p.Description, maxDescriptionLength)
+	p.SiteName = clean(p.SiteName, maxSiteNameLength)
+
+	if img := strings.TrimSpace(html.UnescapeString(first(meta["og:image"], meta["twitter:image"]))); img != "" {
+		if u, err := base.Parse(img); err == nil && (u.Scheme == "http" || u.Scheme == "https") &&
+			len(u.String()) <= maxURLLength {
+			p.ImageURL = u.String()
+		}
+	}
+	return p
+}
+
+// first returns the first non-empty string
+func first(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// clean decodes the HTML entities, collapses the spaces and truncates s to max characters
+func clean(s string, max int) string {
+	s = strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+	if r := []rune(s); len(r) > max {
+		s = strings.TrimSpace(string(r[:max-1])) + "…"
+	}
+	return s
+}
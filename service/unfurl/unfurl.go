@@ -0,0 +1,91 @@
+/*
+Package unfurl builds the previews of the links sent in messages: title, description, image and site name, read from
+the OpenGraph tags of the page (or from its <title> and description, as a fallback).
+
+Pages are fetched by a Fetcher. HTTPFetcher is the real one: it fetches only http(s) URLs, with a timeout and a cap on
+the bytes read, and it refuses to connect to private, loopback and other non-public addresses (unless allowlisted), so
+that users can't make the server probe the internal network. The check is done on the address actually dialed, so it
+also covers redirects and DNS names resolving to private addresses. Tests can use any Fetcher, or an HTTPFetcher that
+allows 127.0.0.1 to reach an httptest server.
+*/
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Preview is the preview of a link
+type Preview struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+	SiteName    string
+}
+
+// Fetcher fetches the preview of a link
+type Fetcher interface {
+	Fetch(ctx context.Context, rawURL string) (*Preview, error)
+}
+
+var (
+	// ErrNoPreview is returned when the page has nothing to show in a preview, or is not an HTML page
+	ErrNoPreview = errors.New("no preview available")
+	// ErrBlockedAddress is returned when the link points to an address that can't be fetched
+	ErrBlockedAddress = errors.New("address not allowed")
+)
+
+// maxURLLength is the maximum length of a link to preview
+const maxURLLength = 2048
+
+// ExtractURLs returns the http(s) URLs written in the text, without duplicates, in the order they appear. Punctuation
+// right after a URL (like the full stop ending a sentence) is not part of it.
+func ExtractURLs(text string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		if !strings.HasPrefix(rest, "http://") && !strings.HasPrefix(rest, "https://") ||
+			i > 0 && !strings.ContainsRune(" \t\r\n([{<\"'", rune(text[i-1])) {
+			i++
+			continue
+		}
+
+		end := strings.IndexAny(rest, " \t\r\n<>\"")
+		if end < 0 {
+			end = len(rest)
+		}
+		u := trimURL(rest[:end])
+		i += end
+		if len(u) > maxURLLength || seen[u] {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || parsed.Host == "" {
+			continue
+		}
+		seen[u] = true
+		out = append(out, u)
+	}
+	return out
+}
+
+// trimURL removes the trailing punctuation, and the closing brackets that have no opening one in the URL
+func trimURL(u string) string {
+	for len(u) > 0 {
+		last := u[len(u)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'\"", last) >= 0:
+			u = u[:len(u)-1]
+		case last == ')' && strings.Count(u, "(") < strings.Count(u, ")"),
+			last == ']' && strings.Count(u, "[") < strings.Count(u, "]"),
+			last == '}' && strings.Count(u, "{") < strings.Count(u, "}"):
+			u = u[:len(u)-1]
+		default:
+			return u
+		}
+	}
+	return u
+}